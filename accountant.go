@@ -0,0 +1,32 @@
+package shapeio
+
+// Accountant is charged with the bytes transferred by readers and writers,
+// to account bandwidth per tenant centrally.
+type Accountant interface {
+	// Charge charges tenant with n bytes. A non-nil error, such as for an
+	// exceeded quota, fails the operation.
+	Charge(tenant string, n int) error
+}
+
+func (s *shaper) setAccountant(a Accountant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accountant = a
+}
+
+func (s *shaper) setTenant(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenant = tenant
+}
+
+// account charges the accountant with n bytes.
+func (s *shaper) account(n int) error {
+	s.mu.Lock()
+	a, tenant := s.accountant, s.tenant
+	s.mu.Unlock()
+	if a == nil || n <= 0 {
+		return nil
+	}
+	return a.Charge(tenant, n)
+}
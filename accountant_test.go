@@ -0,0 +1,54 @@
+package shapeio_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/cryks/shapeio"
+)
+
+var errDenied = errors.New("denied")
+
+// limitAccountant denies charges after a threshold per tenant.
+type limitAccountant struct {
+	mu        sync.Mutex
+	threshold int
+	charged   map[string]int
+}
+
+func (a *limitAccountant) Charge(tenant string, n int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.charged[tenant]+n > a.threshold {
+		return errDenied
+	}
+	a.charged[tenant] += n
+	return nil
+}
+
+func TestAccountant(t *testing.T) {
+	a := &limitAccountant{threshold: 3 * 1024, charged: map[string]int{}}
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateLimit(1024 * 1024) // 1MB/sec
+	w.SetAccountant(a)
+	w.SetTenant("alice")
+
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(make([]byte, 1024)); err != nil {
+			t.Fatalf("write %d failed: %s", i, err)
+		}
+	}
+	if n, err := w.Write(make([]byte, 1024)); err != errDenied || n != 0 {
+		t.Errorf("Write over the threshold returned %d, %v", n, err)
+	}
+
+	w.SetTenant("bob")
+	if _, err := w.Write(make([]byte, 1024)); err != nil {
+		t.Errorf("write of another tenant failed: %s", err)
+	}
+	if a.charged["alice"] != 3*1024 || a.charged["bob"] != 1024 {
+		t.Errorf("unexpected charges %v", a.charged)
+	}
+}
@@ -0,0 +1,87 @@
+package shapeio
+
+import "context"
+
+// SetMaxConcurrent limits the transfers in flight across the wrappers sharing
+// the limiter to n, the others blocking until a slot is free, in the order
+// they arrived. A transfer, one chunk of a Read or Write, holds its slot from
+// the underlying I/O through its wait for the rate limit. Zero or less
+// removes the limit.
+func (l *Limiter) SetMaxConcurrent(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxConcurrent = n
+	l.admit()
+}
+
+// admit grants free slots to the queued transfers. l.mu must be held.
+func (l *Limiter) admit() {
+	for len(l.admitQueue) > 0 && (l.maxConcurrent <= 0 || l.active < l.maxConcurrent) {
+		l.active++
+		close(l.admitQueue[0])
+		l.admitQueue = l.admitQueue[1:]
+	}
+}
+
+// acquire waits for a slot of a transfer.
+func (l *Limiter) acquire(ctx context.Context, closed <-chan struct{}) error {
+	l.mu.Lock()
+	if l.maxConcurrent <= 0 || l.active < l.maxConcurrent && len(l.admitQueue) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.admitQueue = append(l.admitQueue, ready)
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-closed:
+		err = context.Canceled
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ch := range l.admitQueue {
+		if ch == ready {
+			l.admitQueue = append(l.admitQueue[:i], l.admitQueue[i+1:]...)
+			return err
+		}
+	}
+	// granted meanwhile
+	l.active--
+	l.admit()
+	return err
+}
+
+// release frees the slot of a transfer.
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.admit()
+}
+
+// admitTransfer waits for a slot of the shared limiter, if any, and returns
+// the function to free it.
+func (s *shaper) admitTransfer(ctx context.Context) (func(), error) {
+	l, _ := s.sharedLimiter()
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := s.done(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.acquire(ctx, s.closing); err != nil {
+		if derr := s.done(ctx); derr != nil {
+			return nil, derr
+		}
+		return nil, err
+	}
+	return l.release, nil
+}
@@ -0,0 +1,149 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// WriteBuffers writes bufs in order as one unit, waiting for the rate limit
+// for their combined length. As Write does, it splits the combined length
+// into pieces of the burst, each written by one vectored I/O and waited for
+// once. It uses the vectored I/O of the underlying writer if supported, as
+// net.Buffers does. Under SetMaxWriteLatency, it writes only the leading bytes
+// that the bound allows of the combined length, returning the count with no
+// error as Write does.
+func (s *Writer) WriteBuffers(bufs net.Buffers) (int64, error) {
+	return s.WriteBuffersContext(s.ctx, bufs)
+}
+
+// WriteBuffersContext is like WriteBuffers, but waits for the rate limit
+// until ctx is done.
+func (s *Writer) WriteBuffersContext(ctx context.Context, bufs net.Buffers) (int64, error) {
+	if s.leakyBucket() != nil || s.postTransform() != nil {
+		// the buffers are queued or transformed one by one
+		var written int64
+		for _, p := range bufs {
+			n, err := s.WriteContext(ctx, p)
+			written += int64(n)
+			if err != nil || n < len(p) {
+				// the caller writes the rest
+				return written, err
+			}
+		}
+		return written, nil
+	}
+	if err := s.waitStart(ctx); err != nil {
+		return 0, err
+	}
+	if err := s.flushFirst(ctx); err != nil {
+		return 0, err
+	}
+	var size int
+	for _, p := range bufs {
+		size += len(p)
+	}
+	if m := s.latencyAllowance(ctx); m > 0 && size > m {
+		// the caller writes the rest
+		size = m
+	}
+	// write in pieces not to exceed the rate limit at once
+	chunk := s.chunkSize()
+	var written int64
+	for written < int64(size) {
+		m := size - int(written)
+		if m > chunk {
+			m = chunk
+		}
+		piece := sliceBuffers(bufs, written, m)
+		n, err := s.writeBuffersContext(ctx, piece, m)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < int64(m) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// writeBuffersContext writes bufs of size bytes at once, waiting for the rate
+// limit with ctx.
+func (s *Writer) writeBuffersContext(ctx context.Context, bufs net.Buffers, size int) (int64, error) {
+	release, err := s.admitTransfer(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if err := s.waitLatency(ctx); err != nil {
+		return 0, err
+	}
+	n, err := s.writeBuffers(bufs, size)
+	var cost int
+	for i, rest := 0, n; i < len(bufs) && rest > 0; i++ {
+		p := bufs[i]
+		if int64(len(p)) > rest {
+			p = p[:rest]
+		}
+		cost += s.cost(p)
+		rest -= int64(len(p))
+	}
+	// bytes transferred along with an error are charged too
+	if werr := s.wait(ctx, cost); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// writeBuffers writes bufs of size bytes to the underlying writer without
+// waiting for the rate limit.
+func (s *Writer) writeBuffers(bufs net.Buffers, size int) (int64, error) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	if s.quotaAllowance(size) < size {
+		return 0, ErrQuotaExceeded
+	}
+	if err := s.account(size); err != nil {
+		return 0, err
+	}
+	// WriteTo consumes the buffers
+	bufs = append(net.Buffers(nil), bufs...)
+	limiter, tokens := s.pauseTokens()
+	start := time.Now()
+	n, err := bufs.WriteTo(s.w)
+	s.resumeTokens(limiter, tokens)
+	s.recordIO(start, int(n))
+	s.record(int(n))
+	return n, err
+}
+
+// sliceBuffers returns the buffers of bufs holding the n bytes from off, the
+// first and the last of them cut to fit.
+func sliceBuffers(bufs net.Buffers, off int64, n int) net.Buffers {
+	sliced := make(net.Buffers, 0, len(bufs))
+	for _, p := range bufs {
+		if n <= 0 {
+			break
+		}
+		if off >= int64(len(p)) {
+			off -= int64(len(p))
+			continue
+		}
+		p = p[off:]
+		off = 0
+		if len(p) > n {
+			p = p[:n]
+		}
+		sliced = append(sliced, p)
+		n -= len(p)
+	}
+	return sliced
+}
@@ -0,0 +1,155 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestWriteBuffers(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(limit)
+
+	bufs := net.Buffers{
+		bytes.Repeat([]byte("a"), 5*1024),
+		bytes.Repeat([]byte("b"), 10*1024),
+		bytes.Repeat([]byte("c"), 5*1024),
+	}
+	want := bytes.Join(bufs, nil)
+	start := time.Now()
+	n, err := w.WriteBuffers(bufs)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) || !bytes.Equal(dst.Bytes(), want) {
+		t.Errorf("wrote %d bytes out of order", n)
+	}
+	// 20KB in total waits for 200ms
+	if elapsed < 180*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Errorf("WriteBuffers of 20KB took %s, want about 200ms", elapsed)
+	}
+	if w.Waits() != 1 {
+		t.Errorf("WriteBuffers waited %d times, want once", w.Waits())
+	}
+	if len(bufs) != 3 || len(bufs[0]) != 5*1024 {
+		t.Error("WriteBuffers consumed the buffers")
+	}
+}
+
+func TestWriteBuffersMaxWriteLatency(t *testing.T) {
+	d := 100 * time.Millisecond
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(10 * 1024) // 10KB/sec
+	w.SetMaxWriteLatency(d)
+
+	src := bytes.Repeat([]byte("ab"), 2*1024)
+	var writes int
+	for p := src; len(p) > 0; writes++ {
+		start := time.Now()
+		n, err := w.WriteBuffers(net.Buffers{p[:len(p)/2], p[len(p)/2:]})
+		if elapsed := time.Since(start); elapsed > d+50*time.Millisecond {
+			t.Errorf("WriteBuffers of %d bytes blocked %s", n, elapsed)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			t.Fatal("WriteBuffers wrote nothing")
+		}
+		p = p[n:]
+	}
+	if !bytes.Equal(dst.Bytes(), src) || writes < 4 {
+		t.Errorf("%d bytes in %d writes", dst.Len(), writes)
+	}
+}
+
+func TestWriteBuffersLatencyFunc(t *testing.T) {
+	w := shapeio.NewWriter(ioutil.Discard)
+	var calls int
+	w.SetLatencyFunc(func() time.Duration {
+		calls++
+		return 100 * time.Millisecond
+	})
+
+	start := time.Now()
+	if _, err := w.WriteBuffers(net.Buffers{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("WriteBuffers took %s, want the latency of 100ms", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("latency func called %d times, want once", calls)
+	}
+}
+
+func TestWriteBuffersBurst(t *testing.T) {
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(100 * 1024) // 100KB/sec
+	w.SetBurst(4 * 1024)
+
+	bufs := net.Buffers{
+		bytes.Repeat([]byte("a"), 5*1024),
+		bytes.Repeat([]byte("b"), 5*1024),
+		bytes.Repeat([]byte("c"), 5*1024),
+	}
+	want := bytes.Join(bufs, nil)
+	n, err := w.WriteBuffers(bufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) || !bytes.Equal(dst.Bytes(), want) {
+		t.Errorf("wrote %d bytes out of order", n)
+	}
+	// 15KB in pieces of 4KB
+	if w.Waits() != 4 {
+		t.Errorf("WriteBuffers waited %d times, want 4 pieces", w.Waits())
+	}
+}
+
+func TestSetPostTransform(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(limit)
+	w.SetPostTransform(func(p []byte) ([]byte, error) {
+		return append(append([]byte(nil), p...), p...), nil
+	})
+	src := make([]byte, 10*1024)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		n, err := w.Write(src[:len(src)/4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(src)/4 {
+			t.Errorf("Write() = %d, want %d", n, len(src)/4)
+		}
+	}
+	elapsed := time.Since(start)
+	if dst.Len() != 2*len(src) {
+		t.Fatalf("%d bytes on the wire, want %d", dst.Len(), 2*len(src))
+	}
+	wireRate := float64(dst.Len()) / elapsed.Seconds()
+	if wireRate > limit*1.05 || wireRate < limit*0.8 {
+		t.Errorf("Limit %f but wire rate %f", limit, wireRate)
+	}
+
+	errTransform := errors.New("transform failed")
+	w.SetPostTransform(func(p []byte) ([]byte, error) {
+		return nil, errTransform
+	})
+	if n, err := w.Write(src); n != 0 || err != errTransform {
+		t.Errorf("Write() = %d, %v, want 0, %v", n, err, errTransform)
+	}
+}
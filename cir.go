@@ -0,0 +1,106 @@
+package shapeio
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// committedBurst is the span of the committed rate that may be saved up while
+// bandwidth is taken from the excess pool.
+const committedBurst = 100 * time.Millisecond
+
+func (s *shaper) setCIR(committed, peak float64) error {
+	if committed == 0 {
+		s.mu.Lock()
+		s.committed = nil
+		s.mu.Unlock()
+		return nil
+	}
+	if math.IsNaN(committed) || math.IsNaN(peak) || committed < 0 || math.IsInf(committed, 1) || peak < committed {
+		return ErrInvalidRate
+	}
+	if err := s.setRateLimit(peak); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applyCommitted(committed)
+	return nil
+}
+
+func (s *shaper) committedLimiter() *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.committed
+}
+
+// waitCommitted waits for n tokens of the committed rate, unless the excess
+// pool has spare tokens.
+func (s *shaper) waitCommitted(ctx context.Context, committed *rate.Limiter, excess *Limiter, n int) error {
+	if n <= committed.Burst() && committed.AllowN(time.Now(), n) {
+		return nil
+	}
+	if excess != nil && excess.allow(n) {
+		return nil
+	}
+	return s.waitLimiter(ctx, committed, n)
+}
+
+// allow takes n tokens if available immediately and no one is waiting.
+func (l *Limiter) allow(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.availableLocked(n) {
+		return false
+	}
+	l.chargeLocked(n)
+	return true
+}
+
+// available reports whether n tokens are available immediately and no one is
+// waiting, without consuming them.
+func (l *Limiter) available(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.availableLocked(n)
+}
+
+func (l *Limiter) availableLocked(n int) bool {
+	if len(l.waiters) > 0 {
+		return false
+	}
+	return l.limiter == nil || l.limiter.TokensAt(time.Now()) >= float64(n)
+}
+
+// charge consumes n tokens after the fact, even if not available.
+func (l *Limiter) charge(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.chargeLocked(n)
+}
+
+func (l *Limiter) chargeLocked(n int) {
+	if l.limiter != nil {
+		burnTokens(l.limiter, time.Now(), float64(n))
+	}
+}
+
+// applyCommitted sets the committed rate (bytes/sec) of SetCIR, or removes it
+// if zero. s.mu must be held.
+func (s *shaper) applyCommitted(committed float64) {
+	if committed == 0 {
+		s.committed = nil
+		return
+	}
+	burst := bytesFor(committed, committedBurst)
+	if s.committed == nil {
+		s.committed = rate.NewLimiter(rate.Limit(committed), burst)
+		s.committed.AllowN(time.Now(), burst) // spend initial burst
+	} else {
+		s.committed.SetLimit(rate.Limit(committed))
+		s.committed.SetBurst(burst)
+	}
+}
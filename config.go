@@ -0,0 +1,249 @@
+package shapeio
+
+import (
+	"math"
+	"time"
+)
+
+// Config is the configuration of a Reader or Writer, to be re-applied to
+// another one, such as when recreating the wrappers on a reload. It holds the
+// plain settings; the functions, limiters, controllers, stores and
+// accountants set to the wrapper are not part of it, as they cannot be
+// serialized, nor is the state of the wrapper. The settings of one type of
+// wrapper are ignored by the other.
+type Config struct {
+	// RateLimit is the rate limit (bytes/sec), or 0 if unlimited.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	// CommittedRate is the committed rate of SetCIR, whose peak rate is
+	// RateLimit. Zero disables it.
+	CommittedRate float64 `json:"committed_rate,omitempty"`
+	// BaselineRate is set by SetBaselineRate, or nil if not set.
+	BaselineRate *float64 `json:"baseline_rate,omitempty"`
+	// Burst is set by SetBurst, and BurstMultiplier by SetBurstMultiplier.
+	Burst           int     `json:"burst,omitempty"`
+	BurstMultiplier float64 `json:"burst_multiplier,omitempty"`
+	// MTU and PacketOverhead are set by SetPacketModel.
+	MTU            int `json:"mtu,omitempty"`
+	PacketOverhead int `json:"packet_overhead,omitempty"`
+	// MinRate and MaxRate are the bounds set by SetRateBounds.
+	MinRate float64 `json:"min_rate,omitempty"`
+	MaxRate float64 `json:"max_rate,omitempty"`
+	// RampDuration is set by SetRampDuration.
+	RampDuration time.Duration `json:"ramp_duration,omitempty"`
+	// RateSmoothing is the factor of SetRateSmoothing, or 0 if disabled.
+	RateSmoothing float64 `json:"rate_smoothing,omitempty"`
+	// InitialDelay is set by SetInitialDelay, and StartAlignment by
+	// SetStartAlignment.
+	InitialDelay   time.Duration `json:"initial_delay,omitempty"`
+	StartAlignment time.Duration `json:"start_alignment,omitempty"`
+	// CatchUp is set by SetCatchUp, and CatchUpOvershoot by
+	// SetCatchUpOvershoot.
+	CatchUp          bool    `json:"catch_up,omitempty"`
+	CatchUpOvershoot float64 `json:"catch_up_overshoot,omitempty"`
+	// Priority is set by SetPriority, and BypassShared by SetBypassShared.
+	Priority     int  `json:"priority,omitempty"`
+	BypassShared bool `json:"bypass_shared,omitempty"`
+	// Tenant is set by SetTenant, and Label by SetLabel.
+	Tenant string `json:"tenant,omitempty"`
+	Label  string `json:"label,omitempty"`
+	// FailureRate and FailureErr are set by SetFailureRate. FailureErr is
+	// kept in memory only, as an error cannot be serialized.
+	FailureRate float64 `json:"failure_rate,omitempty"`
+	FailureErr  error   `json:"-"`
+
+	// SlowStartBytes and SlowStartRate are set by SetSlowStart of Reader.
+	SlowStartBytes int64   `json:"slow_start_bytes,omitempty"`
+	SlowStartRate  float64 `json:"slow_start_rate,omitempty"`
+	// MinReadSize is set by SetMinReadSize of Reader, and MinDuration by
+	// SetMinDuration.
+	MinReadSize int           `json:"min_read_size,omitempty"`
+	MinDuration time.Duration `json:"min_duration,omitempty"`
+
+	// WriteBufferSize is set by SetWriteBufferSize of Writer, and
+	// MaxWriteLatency by SetMaxWriteLatency.
+	WriteBufferSize int           `json:"write_buffer_size,omitempty"`
+	MaxWriteLatency time.Duration `json:"max_write_latency,omitempty"`
+	// LeakyBucket is the capacity of SetLeakyBucket of Writer, or 0 if
+	// disabled. Lossy and FlushOnCancel are set by SetLossy and
+	// SetFlushOnCancel.
+	LeakyBucket   int  `json:"leaky_bucket,omitempty"`
+	Lossy         bool `json:"lossy,omitempty"`
+	FlushOnCancel bool `json:"flush_on_cancel,omitempty"`
+}
+
+// DumpConfig returns the configuration of the reader, to be applied to another
+// wrapper by ApplyConfig.
+func (s *Reader) DumpConfig() Config {
+	c := s.dumpConfig()
+	s.bufMu.Lock()
+	c.MinReadSize = s.minRead
+	s.bufMu.Unlock()
+	s.minDur.mu.Lock()
+	c.MinDuration = s.minDur.d
+	s.minDur.mu.Unlock()
+	return c
+}
+
+// ApplyConfig applies c, such as returned by DumpConfig, to the reader. The
+// rate limit applies at once, without the ramp of SetRampDuration. Invalid
+// rates return ErrInvalidRate, and an invalid smoothing factor returns
+// ErrInvalidSmoothing, leaving the reader as is.
+func (s *Reader) ApplyConfig(c Config) error {
+	prev := s.DumpConfig()
+	if err := s.applyConfig(c); err != nil {
+		return err
+	}
+	// unchanged ones keep their progress
+	if prev.SlowStartBytes != c.SlowStartBytes || prev.SlowStartRate != c.SlowStartRate {
+		s.SetSlowStart(c.SlowStartBytes, c.SlowStartRate)
+	}
+	if prev.MinDuration != c.MinDuration {
+		s.SetMinDuration(c.MinDuration)
+	}
+	s.SetMinReadSize(c.MinReadSize)
+	return nil
+}
+
+// DumpConfig returns the configuration of the writer, to be applied to another
+// wrapper by ApplyConfig.
+func (s *Writer) DumpConfig() Config {
+	c := s.dumpConfig()
+	s.mu.Lock()
+	c.MaxWriteLatency = s.maxLatency
+	s.mu.Unlock()
+	s.wbuf.mu.Lock()
+	c.WriteBufferSize = s.wbuf.size
+	s.wbuf.mu.Unlock()
+	if b := s.leakyBucket(); b != nil {
+		b.mu.Lock()
+		c.LeakyBucket, c.Lossy, c.FlushOnCancel = b.capacity, b.lossy, b.flush
+		b.mu.Unlock()
+	}
+	return c
+}
+
+// ApplyConfig applies c, such as returned by DumpConfig, to the writer. The
+// rate limit applies at once, without the ramp of SetRampDuration. Invalid
+// rates return ErrInvalidRate, and an invalid smoothing factor returns
+// ErrInvalidSmoothing, leaving the writer as is. Turning leaky bucket mode
+// off waits for its queue to drain, as SetLeakyBucket does.
+func (s *Writer) ApplyConfig(c Config) error {
+	if err := s.applyConfig(c); err != nil {
+		return err
+	}
+	s.SetMaxWriteLatency(c.MaxWriteLatency)
+	s.SetWriteBufferSize(c.WriteBufferSize)
+	s.SetLeakyBucket(c.LeakyBucket)
+	s.SetLossy(c.Lossy)
+	s.SetFlushOnCancel(c.FlushOnCancel)
+	return nil
+}
+
+func (s *shaper) dumpConfig() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := Config{
+		RateLimit:        s.targetRate(),
+		Burst:            s.burst,
+		BurstMultiplier:  s.burstMultiplier,
+		MTU:              s.mtu,
+		PacketOverhead:   s.overhead,
+		MinRate:          s.minRate,
+		MaxRate:          s.maxRate,
+		RampDuration:     s.rampDuration,
+		RateSmoothing:    s.meter.alpha,
+		InitialDelay:     s.initialDelay,
+		StartAlignment:   s.startAlignment,
+		CatchUp:          s.catchUp,
+		CatchUpOvershoot: s.overshoot,
+		Priority:         s.priority,
+		BypassShared:     s.bypassShared,
+		Tenant:           s.tenant,
+		Label:            s.label,
+		FailureRate:      s.failRate,
+		FailureErr:       s.failErr,
+	}
+	if s.committed != nil {
+		c.CommittedRate = float64(s.committed.Limit())
+	}
+	if s.baseline != nil {
+		baseline := *s.baseline
+		c.BaselineRate = &baseline
+	}
+	if s.slowStart != nil {
+		c.SlowStartBytes = s.slowStart.n
+		c.SlowStartRate = float64(s.slowStart.limiter.Limit())
+	}
+	return c
+}
+
+// validRate reports whether bytesPerSec is a rate of Config.
+func validRate(bytesPerSec float64) bool {
+	return !math.IsNaN(bytesPerSec) && bytesPerSec >= 0
+}
+
+// applyConfig applies the settings of c common to readers and writers, the
+// rate limit at once without a ramp.
+func (s *shaper) applyConfig(c Config) error {
+	if !validRate(c.RateLimit) || !validRate(c.MinRate) || !validRate(c.MaxRate) || c.MaxRate > 0 && c.MaxRate < c.MinRate {
+		return ErrInvalidRate
+	}
+	if !validRate(c.CommittedRate) || math.IsInf(c.CommittedRate, 1) || c.RateLimit > 0 && c.RateLimit < c.CommittedRate {
+		return ErrInvalidRate
+	}
+	if c.BaselineRate != nil && !validRate(*c.BaselineRate) {
+		return ErrInvalidRate
+	}
+	if math.IsNaN(c.RateSmoothing) || c.RateSmoothing < 0 || c.RateSmoothing > 1 {
+		return ErrInvalidSmoothing
+	}
+	if c.RateSmoothing == 1 {
+		c.RateSmoothing = 0
+	}
+	if c.Burst <= 0 || c.Burst > burstLimit {
+		c.Burst = 0
+	}
+	if math.IsNaN(c.BurstMultiplier) || c.BurstMultiplier < 0 {
+		c.BurstMultiplier = 0
+	}
+	if c.MTU <= 0 {
+		c.MTU, c.PacketOverhead = 0, 0
+	}
+	if c.CatchUpOvershoot == 0 {
+		c.CatchUpOvershoot = defaultOvershoot
+	}
+
+	s.mu.Lock()
+	s.burst = c.Burst
+	s.burstMultiplier = c.BurstMultiplier
+	s.mtu, s.overhead = c.MTU, c.PacketOverhead
+	s.minRate, s.maxRate = c.MinRate, c.MaxRate
+	if s.meter.alpha != c.RateSmoothing {
+		s.meter.alpha = c.RateSmoothing
+		s.meter.smoothed = s.meter.rate
+	}
+	s.initialDelay = c.InitialDelay
+	s.startAlignment = c.StartAlignment
+	s.catchUp = c.CatchUp
+	s.overshoot = c.CatchUpOvershoot
+	s.priority = c.Priority
+	s.bypassShared = c.BypassShared
+	s.tenant = c.Tenant
+	s.label = c.Label
+	s.failRate, s.failErr = c.FailureRate, c.FailureErr
+	s.baseline = nil
+	if c.BaselineRate != nil {
+		baseline := *c.BaselineRate
+		s.baseline = &baseline
+	}
+	s.applyCommitted(c.CommittedRate)
+	s.rampDuration = 0
+	err := s.applyRateLimit(c.RateLimit)
+	s.rampDuration = c.RampDuration
+	thrashed := s.thrash.count(time.Now())
+	s.mu.Unlock()
+	if thrashed != nil {
+		thrashed()
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package shapeio_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// writeTime returns the time to write n bytes to w in pieces of 512 bytes.
+func writeTime(t *testing.T, w *shapeio.Writer, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for written := 0; written < n; written += 512 {
+		if _, err := w.Write(make([]byte, 512)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestApplyConfig(t *testing.T) {
+	a := shapeio.NewWriter(ioutil.Discard)
+	a.SetRateLimit(20 * 1024) // 20KB/sec
+	a.SetBurst(1024)
+	a.SetPacketModel(1500, 40)
+	if err := a.SetRateBounds(1024, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	a.SetInitialDelay(100 * time.Millisecond)
+	a.SetLabel("upload")
+
+	c := a.DumpConfig()
+	b := shapeio.NewWriter(ioutil.Discard)
+	if err := b.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.DumpConfig(); !reflect.DeepEqual(got, c) {
+		t.Errorf("DumpConfig() = %+v after ApplyConfig, want %+v", got, c)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded shapeio.Config
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, c) {
+		t.Errorf("JSON round trip = %+v, want %+v", decoded, c)
+	}
+
+	// 100ms of initial delay and about 200ms of the rate limit each
+	da, db := writeTime(t, a, 4096), writeTime(t, b, 4096)
+	if da < 250*time.Millisecond || db < 250*time.Millisecond || db > da+100*time.Millisecond || da > db+100*time.Millisecond {
+		t.Errorf("writes took %s and %s, want both about 300ms", da, db)
+	}
+	if r, _ := b.StepUp(10); r != 64*1024 {
+		t.Errorf("StepUp(10) = %.0f, want the bound %d", r, 64*1024)
+	}
+
+	if err := b.ApplyConfig(shapeio.Config{MinRate: 2, MaxRate: 1}); err != shapeio.ErrInvalidRate {
+		t.Errorf("ApplyConfig with invalid bounds = %v, want ErrInvalidRate", err)
+	}
+}
+
+// zeroFields returns the names of the fields of c left zero, other than
+// those in skip.
+func zeroFields(c shapeio.Config, skip ...string) []string {
+	var zero []string
+	v := reflect.ValueOf(c)
+fields:
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		for _, s := range skip {
+			if s == name {
+				continue fields
+			}
+		}
+		if v.Field(i).IsZero() {
+			zero = append(zero, name)
+		}
+	}
+	return zero
+}
+
+// configure sets every setting of Config in common to readers and writers.
+func configure(t *testing.T, s interface {
+	SetRateLimit(bytesPerSec float64)
+	SetCIR(committed, peak float64) error
+	SetBaselineRate(bytesPerSec float64)
+	SetBurst(n int)
+	SetBurstMultiplier(m float64)
+	SetPacketModel(mtu int, perPacketOverhead int)
+	SetRateBounds(min, max float64) error
+	SetRampDuration(d time.Duration)
+	SetRateSmoothing(alpha float64) error
+	SetInitialDelay(d time.Duration)
+	SetStartAlignment(d time.Duration)
+	SetCatchUp(enabled bool)
+	SetCatchUpOvershoot(factor float64)
+	SetPriority(priority int)
+	SetBypassShared(bypass bool)
+	SetTenant(tenant string)
+	SetLabel(label string)
+	SetFailureRate(p float64, err error)
+}) {
+	t.Helper()
+	if err := s.SetCIR(10*1024, 20*1024); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBaselineRate(15 * 1024)
+	s.SetBurst(1024)
+	s.SetBurstMultiplier(0.1)
+	s.SetPacketModel(1500, 40)
+	if err := s.SetRateBounds(1024, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRampDuration(time.Second)
+	if err := s.SetRateSmoothing(0.5); err != nil {
+		t.Fatal(err)
+	}
+	s.SetInitialDelay(10 * time.Millisecond)
+	s.SetStartAlignment(time.Millisecond)
+	s.SetCatchUp(true)
+	s.SetCatchUpOvershoot(3)
+	s.SetPriority(2)
+	s.SetBypassShared(true)
+	s.SetTenant("tenant")
+	s.SetLabel("label")
+	s.SetFailureRate(0.001, errors.New("injected"))
+}
+
+func TestApplyConfigRoundTrip(t *testing.T) {
+	readerOnly := []string{"SlowStartBytes", "SlowStartRate", "MinReadSize", "MinDuration"}
+	writerOnly := []string{"WriteBufferSize", "MaxWriteLatency", "LeakyBucket", "Lossy", "FlushOnCancel"}
+
+	w := shapeio.NewWriter(ioutil.Discard)
+	configure(t, w)
+	w.SetWriteBufferSize(4096)
+	w.SetMaxWriteLatency(50 * time.Millisecond)
+	w.SetLeakyBucket(8192)
+	w.SetLossy(true)
+	w.SetFlushOnCancel(true)
+	defer w.Close()
+
+	c := w.DumpConfig()
+	if zero := zeroFields(c, readerOnly...); len(zero) > 0 {
+		t.Errorf("writer config misses %v", zero)
+	}
+	w2 := shapeio.NewWriter(ioutil.Discard)
+	defer w2.Close()
+	if err := w2.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := w2.DumpConfig(); !reflect.DeepEqual(got, c) {
+		t.Errorf("writer DumpConfig() = %+v after ApplyConfig, want %+v", got, c)
+	}
+
+	r := shapeio.NewReader(zeroReader{})
+	configure(t, r)
+	r.SetSlowStart(1024, 512)
+	r.SetMinReadSize(2048)
+	r.SetMinDuration(time.Second)
+
+	c = r.DumpConfig()
+	if zero := zeroFields(c, writerOnly...); len(zero) > 0 {
+		t.Errorf("reader config misses %v", zero)
+	}
+	r2 := shapeio.NewReader(zeroReader{})
+	if err := r2.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := r2.DumpConfig(); !reflect.DeepEqual(got, c) {
+		t.Errorf("reader DumpConfig() = %+v after ApplyConfig, want %+v", got, c)
+	}
+
+	// all but FailureErr survive JSON
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded shapeio.Config
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	c.FailureErr = nil
+	if !reflect.DeepEqual(decoded, c) {
+		t.Errorf("JSON round trip = %+v, want %+v", decoded, c)
+	}
+}
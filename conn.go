@@ -0,0 +1,49 @@
+package shapeio
+
+import "net"
+
+// Conn is a net.Conn with rate limiting, set separately for each direction.
+type Conn struct {
+	net.Conn
+	r *Reader
+	w *Writer
+}
+
+// NewConn returns a connection that implements net.Conn with rate limiting.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn: c,
+		r:    NewReader(c),
+		w:    NewWriter(c),
+	}
+}
+
+// SetReadRateLimit sets rate limit (bytes/sec) to reading from the connection.
+// Zero removes the rate limit.
+func (c *Conn) SetReadRateLimit(bytesPerSec float64) error {
+	return c.r.SetRateLimitErr(bytesPerSec)
+}
+
+// SetWriteRateLimit sets rate limit (bytes/sec) to writing to the connection.
+// Zero removes the rate limit.
+func (c *Conn) SetWriteRateLimit(bytesPerSec float64) error {
+	return c.w.SetRateLimitErr(bytesPerSec)
+}
+
+// Read reads bytes into p.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write writes bytes from p.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close makes pending and further Reads and Writes return ErrClosed, and
+// closes the connection.
+func (c *Conn) Close() error {
+	c.r.close()
+	c.w.close()
+	return c.Conn.Close()
+}
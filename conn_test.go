@@ -0,0 +1,54 @@
+package shapeio_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestConnDirections(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := shapeio.NewConn(a)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, b)
+
+	limit := float64(100 * 1024) // 100KB/sec
+	write := func(size int) time.Duration {
+		start := time.Now()
+		if _, err := conn.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	read := func(size int) time.Duration {
+		go b.Write(make([]byte, size))
+		start := time.Now()
+		if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	conn.SetWriteRateLimit(limit)
+	if d := write(30 * 1024); d < 250*time.Millisecond {
+		t.Errorf("write was not limited: %s", d)
+	}
+	if d := read(1024 * 1024); d > 200*time.Millisecond {
+		t.Errorf("read was limited: %s", d)
+	}
+
+	// swap the capped direction
+	conn.SetWriteRateLimit(0)
+	conn.SetReadRateLimit(limit)
+	if d := write(1024 * 1024); d > 200*time.Millisecond {
+		t.Errorf("write was limited: %s", d)
+	}
+	if d := read(30 * 1024); d < 250*time.Millisecond {
+		t.Errorf("read was not limited: %s", d)
+	}
+}
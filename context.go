@@ -0,0 +1,21 @@
+package shapeio
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+type rateLimitKey struct{}
+
+// WithRateLimit returns a copy of ctx that carries a rate limit (bytes/sec).
+// All ReadContext and WriteContext calls given the returned context share
+// that limit, which takes precedence over the rate limit of the wrapper.
+func WithRateLimit(ctx context.Context, bytesPerSec float64) context.Context {
+	return context.WithValue(ctx, rateLimitKey{}, newLimiter(bytesPerSec))
+}
+
+func contextLimiter(ctx context.Context) *rate.Limiter {
+	l, _ := ctx.Value(rateLimitKey{}).(*rate.Limiter)
+	return l
+}
@@ -0,0 +1,75 @@
+package shapeio_test
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestWithRateLimit(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	sio.SetRateLimit(10 * 1024 * 1024) // 10MB/sec, overridden below
+
+	limits := []float64{
+		100 * 1024, // 100KB/sec
+		400 * 1024, // 400KB/sec
+	}
+	elapsed := make([]time.Duration, len(limits))
+	var wg sync.WaitGroup
+	for i, limit := range limits {
+		wg.Add(1)
+		go func(i int, limit float64) {
+			defer wg.Done()
+			ctx := shapeio.WithRateLimit(context.Background(), limit)
+			start := time.Now()
+			for j := 0; j < 10; j++ {
+				if _, err := sio.WriteContext(ctx, make([]byte, 10*1024)); err != nil {
+					t.Error(err)
+				}
+			}
+			elapsed[i] = time.Since(start)
+		}(i, limit)
+	}
+	wg.Wait()
+
+	for i, limit := range limits {
+		realRate := float64(100*1024) / elapsed[i].Seconds()
+		if realRate > limit || realRate < limit*0.8 {
+			t.Errorf("Limit %f but real rate %f", limit, realRate)
+		}
+	}
+}
+
+func TestWithRateLimitRateChange(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// changes of the writer's own rate limit leave the ctx limit alone
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			sio.SetRateLimit(float64(10+i%2) * 1024 * 1024)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	limit := float64(10 * 1024) // 10KB/sec
+	ctx := shapeio.WithRateLimit(context.Background(), limit)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := sio.WriteContext(ctx, make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if realRate := float64(5*1024) / time.Since(start).Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f while the rate limit changes", limit, realRate)
+	}
+}
@@ -0,0 +1,69 @@
+package shapeio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// watchControl applies the rate commands read from r until EOF or an error.
+func (s *shaper) watchControl(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.control(line); err != nil {
+			if logger := s.getLogger(); logger != nil {
+				logger.Printf("shapeio: control: %s", err)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+func (s *shaper) control(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "rate" {
+		return fmt.Errorf("malformed command %q", line)
+	}
+	bytesPerSec, err := parseRate(fields[1])
+	if err != nil {
+		return fmt.Errorf("malformed command %q: %s", line, err)
+	}
+	return s.setRateLimit(bytesPerSec)
+}
+
+// parseRate parses a rate (bytes/sec) such as "512", "10KB" or "2MB", with an
+// optional unit of B, K(B), M(B) or G(B) in powers of 1024. "unlimited" means
+// no rate limit.
+func parseRate(v string) (float64, error) {
+	if strings.EqualFold(v, "unlimited") {
+		return math.Inf(1), nil
+	}
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+	scale := float64(1)
+	upper := strings.ToUpper(v)
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			v, scale = v[:len(v)-len(u.suffix)], u.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q", v)
+	}
+	return f * scale, nil
+}
@@ -0,0 +1,56 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestWatchControl(t *testing.T) {
+	var logs bytes.Buffer
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetLogger(log.New(&logs, "", 0))
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- w.WatchControl(pr)
+	}()
+
+	rate := func() float64 {
+		if l := w.Limiter(); l != nil {
+			return float64(l.Limit())
+		}
+		return 0
+	}
+	for _, c := range []struct {
+		command string
+		rate    float64
+	}{
+		{"rate 2MB", 2 * 1024 * 1024},
+		{"rate 512", 512},
+		{"rate nope", 512},
+		{"speed 1KB", 512},
+		{"rate 10kb", 10 * 1024},
+		{"rate unlimited", 0},
+	} {
+		fmt.Fprintln(pw, c.command)
+		time.Sleep(10 * time.Millisecond)
+		if r := rate(); r != c.rate {
+			t.Errorf("rate %f after %q, want %f", r, c.command, c.rate)
+		}
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if n := strings.Count(logs.String(), "malformed command"); n != 2 {
+		t.Errorf("%d malformed commands reported, want 2: %q", n, logs.String())
+	}
+}
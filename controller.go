@@ -0,0 +1,119 @@
+package shapeio
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateController decides when bytes may be transferred. It is an optional
+// override: a wrapper waits for its built-in token bucket unless
+// SetRateController or WithController replaces it with a RateController, to
+// implement other shaping algorithms. Its methods may be called concurrently
+// by the transfers of the wrapper and by SetRateLimit.
+type RateController interface {
+	// WaitN blocks until n bytes may be transferred and takes them. n may
+	// exceed any burst of the controller. It must return ctx.Err() promptly
+	// once ctx is done; the wrapper cancels ctx when it is closed.
+	WaitN(ctx context.Context, n int) error
+	// AllowN takes n bytes at now and reports true if they may be
+	// transferred immediately. Otherwise it takes nothing and reports false.
+	AllowN(now time.Time, n int) bool
+	// SetRate sets the rate (bytes/sec). Zero means no rate limit.
+	SetRate(bytesPerSec float64)
+	// Tokens returns the bytes that may be transferred immediately.
+	Tokens() float64
+}
+
+func (s *shaper) setController(c RateController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controller = c
+}
+
+func (s *shaper) getController() RateController {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.controller
+}
+
+// waitController waits for n bytes of c until ctx is done or the wrapper is
+// closed.
+func (s *shaper) waitController(ctx context.Context, c RateController, n int) error {
+	if err := s.done(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := s.withClose(ctx)
+	defer cancel()
+	if err := c.WaitN(ctx, n); err != nil {
+		if derr := s.done(ctx); derr != nil {
+			return derr
+		}
+		return err
+	}
+	return nil
+}
+
+// TokenBucket is a RateController of a plain token bucket, as a starting
+// point for custom controllers. It is not the built-in token bucket of Reader
+// and Writer, which they use without a controller, and provides none of its
+// features such as SetBurst, SetCatchUp and SetRampDuration.
+type TokenBucket struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+}
+
+// NewTokenBucket returns a TokenBucket with rate limit (bytes/sec). Zero
+// means no rate limit.
+func NewTokenBucket(bytesPerSec float64) *TokenBucket {
+	return &TokenBucket{limiter: newLimiter(bytesPerSec)}
+}
+
+func (b *TokenBucket) getLimiter() *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limiter
+}
+
+// WaitN blocks until n tokens are available, in pieces of the burst.
+func (b *TokenBucket) WaitN(ctx context.Context, n int) error {
+	limiter := b.getLimiter()
+	for n > 0 {
+		m := n
+		if burst := limiter.Burst(); m > burst {
+			m = burst
+		}
+		if err := limiter.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// AllowN takes n tokens if available at now.
+func (b *TokenBucket) AllowN(now time.Time, n int) bool {
+	return b.getLimiter().AllowN(now, n)
+}
+
+// SetRate sets rate limit (bytes/sec). Zero means no rate limit.
+func (b *TokenBucket) SetRate(bytesPerSec float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case bytesPerSec <= 0 || bytesPerSec >= MaxRate:
+		b.limiter.SetLimit(rate.Inf)
+	case b.limiter.Limit() == rate.Inf:
+		// start empty rather than with the tokens saved while unlimited
+		b.limiter = newLimiter(bytesPerSec)
+	default:
+		b.limiter.SetLimit(rate.Limit(bytesPerSec))
+	}
+}
+
+// Tokens returns the tokens available now.
+func (b *TokenBucket) Tokens() float64 {
+	return b.getLimiter().Tokens()
+}
@@ -0,0 +1,94 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// countingController allows everything and counts the bytes asked for.
+type countingController struct {
+	mu      sync.Mutex
+	waited  int
+	allowed int
+	rate    float64
+}
+
+func (c *countingController) WaitN(ctx context.Context, n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waited += n
+	return ctx.Err()
+}
+
+func (c *countingController) AllowN(now time.Time, n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowed += n
+	return true
+}
+
+func (c *countingController) SetRate(bytesPerSec float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate = bytesPerSec
+}
+
+func (c *countingController) Tokens() float64 {
+	return 0
+}
+
+func TestSetRateController(t *testing.T) {
+	c := &countingController{}
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 4*1024)))
+	sio.SetRateController(c)
+	sio.SetRateLimit(1024) // 1KB/sec is not waited for by the controller
+	start := time.Now()
+	if _, err := ioutil.ReadAll(sio); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("built-in rate limit applied: %s", elapsed)
+	}
+	if c.waited != 4*1024 || c.rate != 1024 {
+		t.Errorf("controller waited %d bytes at rate %f", c.waited, c.rate)
+	}
+
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateController(c)
+	w.Write(make([]byte, 1024))
+	w.TryWrite(make([]byte, 512))
+	if c.waited != 5*1024 || c.allowed != 512 {
+		t.Errorf("controller waited %d bytes and allowed %d bytes", c.waited, c.allowed)
+	}
+
+	r := shapeio.NewReader(bytes.NewReader(make([]byte, 1024)))
+	r.SetRateLimit(1) // not waited for by the controller
+	r.SetRateController(c)
+	if n, err := r.TryRead(make([]byte, 256)); n != 256 || err != nil {
+		t.Errorf("TryRead = %d, %v; want 256, nil", n, err)
+	}
+	if c.allowed != 768 {
+		t.Errorf("controller allowed %d bytes, want 768", c.allowed)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateController(shapeio.NewTokenBucket(0))
+	w.SetRateLimit(limit)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 20*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realRate := float64(n) / time.Since(start).Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
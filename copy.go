@@ -0,0 +1,193 @@
+package shapeio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned by CopyWithPolicy when a read or write stalls
+// longer than the idle timeout.
+var ErrIdleTimeout = errors.New("shapeio: idle timeout")
+
+// ErrDeadline is returned by CopyWithPolicy when the copy does not complete
+// by the deadline.
+var ErrDeadline = errors.New("shapeio: deadline exceeded")
+
+// copyBufferSize is the maximum buffer size of CopyWithPolicy.
+const copyBufferSize = 32 * 1024
+
+// Policy is a policy of CopyWithPolicy.
+type Policy struct {
+	// Rate is the rate limit (bytes/sec). Zero means no rate limit.
+	Rate float64
+	// IdleTimeout aborts the copy when a read or write stalls longer than
+	// it, excluding the waits for the rate limit. Zero means no timeout.
+	IdleTimeout time.Duration
+	// Deadline aborts the copy when it passes. Zero means no deadline.
+	Deadline time.Time
+}
+
+// idleWatch tracks the underlying I/O in progress.
+type idleWatch struct {
+	mu      sync.Mutex
+	busy    bool
+	since   time.Time
+	aborted bool
+	written int64
+}
+
+// begin marks the start of an I/O. It returns false once aborted.
+func (w *idleWatch) begin() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy, w.since = true, time.Now()
+	return !w.aborted
+}
+
+func (w *idleWatch) end() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy = false
+}
+
+// abort stops further I/O and returns the bytes written so far.
+func (w *idleWatch) abort() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.aborted = true
+	return w.written
+}
+
+// stalled reports whether an I/O is in progress longer than d.
+func (w *idleWatch) stalled(d time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.busy && time.Since(w.since) > d
+}
+
+type watchReader struct {
+	r     io.Reader
+	watch *idleWatch
+}
+
+func (r watchReader) Read(p []byte) (int, error) {
+	if !r.watch.begin() {
+		return 0, io.ErrClosedPipe
+	}
+	defer r.watch.end()
+	return r.r.Read(p)
+}
+
+type watchWriter struct {
+	w     io.Writer
+	watch *idleWatch
+}
+
+func (w watchWriter) Write(p []byte) (int, error) {
+	if !w.watch.begin() {
+		return 0, io.ErrClosedPipe
+	}
+	defer w.watch.end()
+	n, err := w.w.Write(p)
+	w.watch.mu.Lock()
+	w.watch.written += int64(n)
+	w.watch.mu.Unlock()
+	return n, err
+}
+
+// CopyWithPolicy copies from src to dst according to p, until EOF on src or
+// an error. It returns the bytes written, and ErrIdleTimeout or ErrDeadline
+// when aborted by p. A read or write stalled at the abort stays blocked until
+// it returns, but the copy stops there.
+func CopyWithPolicy(dst io.Writer, src io.Reader, p Policy) (int64, error) {
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if p.Deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, p.Deadline)
+	}
+	defer cancel()
+
+	watch := &idleWatch{}
+	r := NewReaderWithContext(watchReader{r: src, watch: watch}, ctx)
+	defer r.deregister()
+	if err := r.SetRateLimitErr(p.Rate); err != nil {
+		return 0, err
+	}
+	size := copyBufferSize
+	if p.Rate > 0 && p.Rate/10 < float64(size) {
+		// wait in pieces of 100ms
+		size = int(p.Rate/10) + 1
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyBuffer(watchWriter{w: dst, watch: watch}, struct{ io.Reader }{r}, make([]byte, size))
+		done <- err
+	}()
+
+	var idle <-chan time.Time
+	if p.IdleTimeout > 0 {
+		interval := p.IdleTimeout / 10
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		idle = t.C
+	}
+	for {
+		select {
+		case err := <-done:
+			n := watch.abort()
+			if err == context.DeadlineExceeded {
+				err = ErrDeadline
+			}
+			return n, err
+		case <-idle:
+			if watch.stalled(p.IdleTimeout) {
+				return watch.abort(), ErrIdleTimeout
+			}
+		case <-ctx.Done():
+			return watch.abort(), ErrDeadline
+		}
+	}
+}
+
+// Calibrate copies from src to dst without rate limiting for d, or until EOF
+// on src, and returns the throughput (bytes/sec) achieved. It is meant for a
+// short measurement phase before shaping the rest of the transfer at a
+// fraction of the measured rate. The bytes read are written to dst, so none
+// are lost to the measurement.
+func Calibrate(dst io.Writer, src io.Reader, d time.Duration) (measured float64, err error) {
+	buf := make([]byte, copyBufferSize)
+	var total int64
+	start := time.Now()
+	for time.Since(start) < d {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			m, werr := dst.Write(buf[:n])
+			total += int64(m)
+			if werr == nil && m < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				err = werr
+				break
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 0 {
+		measured = float64(total) / elapsed.Seconds()
+	}
+	return measured, err
+}
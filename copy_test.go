@@ -0,0 +1,119 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// stallReader returns n bytes and then blocks until closed.
+type stallReader struct {
+	n      int
+	closed chan struct{}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		<-r.closed
+		return 0, io.EOF
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestCopyWithPolicy(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	src := bytes.Repeat([]byte{1}, 20*1024)
+	var dst bytes.Buffer
+	start := time.Now()
+	n, err := shapeio.CopyWithPolicy(&dst, bytes.NewReader(src), shapeio.Policy{
+		Rate:        limit,
+		IdleTimeout: 50 * time.Millisecond, // shorter than the waits for the rate limit
+		Deadline:    time.Now().Add(time.Second),
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(src)) || !bytes.Equal(dst.Bytes(), src) {
+		t.Errorf("copied %d bytes, want %d", n, len(src))
+	}
+	if realRate := float64(n) / elapsed.Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
+
+func TestCopyWithPolicyIdleTimeout(t *testing.T) {
+	src := &stallReader{n: 4 * 1024, closed: make(chan struct{})}
+	defer close(src.closed)
+	start := time.Now()
+	n, err := shapeio.CopyWithPolicy(ioutil.Discard, src, shapeio.Policy{
+		Rate:        100 * 1024, // 100KB/sec
+		IdleTimeout: 100 * time.Millisecond,
+		Deadline:    time.Now().Add(time.Second),
+	})
+	if err != shapeio.ErrIdleTimeout {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n != 4*1024 {
+		t.Errorf("copied %d bytes before the stall, want %d", n, 4*1024)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("idle timeout took %s", elapsed)
+	}
+}
+
+func TestCopyWithPolicyDeadline(t *testing.T) {
+	deadline := 200 * time.Millisecond
+	start := time.Now()
+	_, err := shapeio.CopyWithPolicy(ioutil.Discard, zeroReader{}, shapeio.Policy{
+		Rate:        10 * 1024, // 10KB/sec
+		IdleTimeout: 50 * time.Millisecond,
+		Deadline:    time.Now().Add(deadline),
+	})
+	if err != shapeio.ErrDeadline {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > deadline+200*time.Millisecond {
+		t.Errorf("deadline took %s", elapsed)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	d := 100 * time.Millisecond
+	start := time.Now()
+	measured, err := shapeio.Calibrate(ioutil.Discard, zeroReader{}, d)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < d || elapsed > d+50*time.Millisecond {
+		t.Errorf("calibrated for %s, want %s", elapsed, d)
+	}
+	// far above any rate limit that would throttle it
+	if measured < 10*1024*1024 {
+		t.Errorf("measured %f bytes/sec over a fast source", measured)
+	}
+}
+
+func TestCalibrateEOF(t *testing.T) {
+	src := bytes.Repeat([]byte{1}, 64*1024)
+	var dst bytes.Buffer
+	measured, err := shapeio.Calibrate(&dst, bytes.NewReader(src), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Errorf("copied %d bytes, want %d", dst.Len(), len(src))
+	}
+	if measured <= 0 {
+		t.Errorf("measured %f", measured)
+	}
+}
@@ -0,0 +1,93 @@
+package shapeio
+
+import "sync"
+
+// Shaper is a rate limited wrapper, implemented by Reader and Writer.
+type Shaper interface {
+	SetRateLimitErr(bytesPerSec float64) error
+	SetSharedLimiter(l *Limiter)
+}
+
+// FairSplitter divides a total rate limit (bytes/sec) evenly among the
+// streams registered to it. Each stream is limited to total/N, N being the
+// number of streams registered at the moment, and all of them share a
+// Limiter of the total rate. A FairSplitter is safe for concurrent use.
+type FairSplitter struct {
+	mu      sync.Mutex
+	total   float64
+	limiter *Limiter
+	streams map[Shaper]struct{}
+}
+
+// NewFairSplitter returns a FairSplitter with total rate limit (bytes/sec).
+// Zero means no rate limit.
+func NewFairSplitter(bytesPerSec float64) *FairSplitter {
+	return &FairSplitter{
+		total:   bytesPerSec,
+		limiter: NewLimiter(bytesPerSec),
+		streams: make(map[Shaper]struct{}),
+	}
+}
+
+// SetRateLimit sets total rate limit (bytes/sec) to the splitter and updates
+// the shares of the streams. NaN and negative values return ErrInvalidRate,
+// leaving the splitter unchanged.
+func (f *FairSplitter) SetRateLimit(bytesPerSec float64) error {
+	if !validRate(bytesPerSec) {
+		return ErrInvalidRate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.limiter.SetRateLimit(bytesPerSec); err != nil {
+		return err
+	}
+	f.total = bytesPerSec
+	return f.split()
+}
+
+// Add registers s to the splitter, so that s and the other streams each get
+// an equal share of the total rate limit.
+func (f *FairSplitter) Add(s Shaper) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams[s] = struct{}{}
+	s.SetSharedLimiter(f.limiter)
+	return f.split()
+}
+
+// Remove deregisters s from the splitter, so that the remaining streams speed
+// up. s is left without rate limit.
+func (f *FairSplitter) Remove(s Shaper) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.streams[s]; !ok {
+		return nil
+	}
+	delete(f.streams, s)
+	s.SetSharedLimiter(nil)
+	if err := s.SetRateLimitErr(0); err != nil {
+		return err
+	}
+	return f.split()
+}
+
+// Len returns the number of streams registered to the splitter.
+func (f *FairSplitter) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.streams)
+}
+
+// split sets total/N to each stream. f.mu must be held.
+func (f *FairSplitter) split() error {
+	if len(f.streams) == 0 {
+		return nil
+	}
+	share := f.total / float64(len(f.streams))
+	for s := range f.streams {
+		if err := s.SetRateLimitErr(share); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package shapeio_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// readRate reads n bytes from r and returns the rate (bytes/sec), or 0 on
+// an error. It reports the error by t.Error, so that it can be called from
+// other goroutines than the test's.
+func readRate(t *testing.T, r *shapeio.Reader, n int) float64 {
+	t.Helper()
+	buf := make([]byte, 4*1024)
+	start := time.Now()
+	for read := 0; read < n; {
+		m, err := r.Read(buf)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		read += m
+	}
+	return float64(n) / time.Since(start).Seconds()
+}
+
+func TestFairSplitter(t *testing.T) {
+	total := float64(200 * 1024) // 200KB/sec
+	f := shapeio.NewFairSplitter(total)
+	readers := make([]*shapeio.Reader, 4)
+	for i := range readers {
+		readers[i] = shapeio.NewReader(zeroReader{})
+		if err := f.Add(readers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.Len(); n != 4 {
+		t.Fatalf("Len() = %d, want 4", n)
+	}
+
+	for _, n := range []int{4, 2, 1} {
+		share := total / float64(n)
+		for _, r := range readers[n:f.Len()] {
+			if err := f.Remove(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		realRate := readRate(t, readers[0], int(share/5))
+		if realRate > share*1.05 || realRate < share*0.8 {
+			t.Errorf("%d streams: share %f but real rate %f", n, share, realRate)
+		}
+	}
+
+	// a removed stream is no longer limited
+	if realRate := readRate(t, readers[3], 1024*1024); realRate < total*10 {
+		t.Errorf("removed stream limited to %f", realRate)
+	}
+}
+
+func TestFairSplitterInvalidRate(t *testing.T) {
+	total := float64(20 * 1024) // 20KB/sec
+	f := shapeio.NewFairSplitter(total)
+	r := shapeio.NewReader(zeroReader{})
+	if err := f.Add(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetRateLimit(math.NaN()); err != shapeio.ErrInvalidRate {
+		t.Errorf("SetRateLimit(NaN) = %v, want ErrInvalidRate", err)
+	}
+	// the shared limit of the total is kept
+	r.SetRateLimit(0)
+	if realRate := readRate(t, r, int(total/4)); realRate > total*1.05 {
+		t.Errorf("total %f but real rate %f after an invalid rate", total, realRate)
+	}
+}
@@ -0,0 +1,117 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// FramePacer is an io.WriteCloser that delivers data to the underlying writer
+// in frames of a fixed size, one frame per interval, regardless of the sizes
+// of the Writes. Data short of a frame is buffered until Close.
+type FramePacer struct {
+	w        io.Writer
+	size     int
+	interval time.Duration
+	buf      []byte
+	next     time.Time
+	mu       sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewFramePacer returns a FramePacer that writes frames of frameSize bytes
+// to w every interval. A frameSize less than 1 is treated as 1.
+func NewFramePacer(w io.Writer, frameSize int, interval time.Duration) *FramePacer {
+	if frameSize < 1 {
+		frameSize = 1
+	}
+	return &FramePacer{
+		w:        w,
+		size:     frameSize,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Write buffers p, and writes all complete frames on schedule.
+func (f *FramePacer) Write(p []byte) (int, error) {
+	return f.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write, but stops waiting for the frame slots when ctx
+// is done or the pacer is closed, returning the error with the frames not yet
+// written kept buffered for Close.
+func (f *FramePacer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.isClosed() {
+		return 0, ErrClosed
+	}
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= f.size {
+		if err := f.emit(ctx, f.done, f.size); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close interrupts the pending Writes, writes the buffered frames on schedule,
+// and closes the underlying writer if it implements io.Closer. Writes after
+// Close return ErrClosed.
+func (f *FramePacer) Close() error {
+	f.once.Do(func() { close(f.done) })
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.buf) > 0 {
+		n := f.size
+		if len(f.buf) < n {
+			n = len(f.buf)
+		}
+		if err := f.emit(context.Background(), nil, n); err != nil {
+			return err
+		}
+	}
+	if c, ok := f.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f *FramePacer) isClosed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// emit waits for the next frame slot and writes n buffered bytes. The wait
+// returns ErrClosed once done is closed.
+func (f *FramePacer) emit(ctx context.Context, done <-chan struct{}, n int) error {
+	now := time.Now()
+	if d := f.next.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-done:
+			t.Stop()
+			return ErrClosed
+		}
+		now = f.next
+	}
+	f.next = now.Add(f.interval)
+	if _, err := f.w.Write(f.buf[:n]); err != nil {
+		return err
+	}
+	f.buf = f.buf[n:]
+	return nil
+}
@@ -0,0 +1,92 @@
+package shapeio_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// recordingWriter records the time and size of each Write.
+type recordingWriter struct {
+	mu    sync.Mutex
+	times []time.Time
+	sizes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.times = append(w.times, time.Now())
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
+
+func TestFramePacer(t *testing.T) {
+	interval := 100 * time.Millisecond
+	rec := &recordingWriter{}
+	fp := shapeio.NewFramePacer(rec, 4, interval)
+	fp.Write([]byte("012"))
+	fp.Write([]byte("3456789"))
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{4, 4, 2}
+	if len(rec.sizes) != len(expected) {
+		t.Fatalf("unexpected frames %v", rec.sizes)
+	}
+	for i, size := range expected {
+		if rec.sizes[i] != size {
+			t.Errorf("frame %d has %d bytes, expected %d", i, rec.sizes[i], size)
+		}
+		if i == 0 {
+			continue
+		}
+		gap := rec.times[i].Sub(rec.times[i-1])
+		if gap < interval-10*time.Millisecond || gap > interval+50*time.Millisecond {
+			t.Errorf("frame %d came %s after the previous one", i, gap)
+		}
+	}
+}
+
+func TestFramePacerZeroFrameSize(t *testing.T) {
+	rec := &recordingWriter{}
+	fp := shapeio.NewFramePacer(rec, 0, time.Millisecond)
+	if _, err := fp.Write([]byte("012")); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.sizes) != 3 {
+		t.Errorf("frames %v, want 3 frames of 1 byte", rec.sizes)
+	}
+}
+
+func TestFramePacerInterrupt(t *testing.T) {
+	rec := &recordingWriter{}
+	fp := shapeio.NewFramePacer(rec, 1, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := fp.WriteContext(ctx, []byte("01")); err != context.DeadlineExceeded {
+		t.Errorf("WriteContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fp.Write([]byte("2"))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// Close interrupts the Write, but the rest waits for its slots
+	go fp.Close()
+	select {
+	case err := <-errc:
+		if err != shapeio.ErrClosed {
+			t.Errorf("Write = %v after Close, want %v", err, shapeio.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt Write")
+	}
+}
@@ -0,0 +1,49 @@
+package shapeio
+
+import (
+	"math"
+	"sync"
+)
+
+// global is the process-wide limiter of SetGlobalRateLimit.
+var global struct {
+	mu      sync.Mutex
+	limiter *Limiter
+}
+
+// SetGlobalRateLimit caps the aggregate rate (bytes/sec) of the wrappers
+// created from now on, all of which draw from a process-wide Limiter in
+// addition to their own rate limits and shared limiters: each transfer waits
+// for all of them, so the lowest one prevails. A later change of the cap
+// applies to the wrappers drawing from it already. Zero, MaxRate or more, and
+// +Inf remove the cap, leaving the existing wrappers unlimited by it. NaN and
+// negative values remove it too, but return ErrInvalidRate.
+func SetGlobalRateLimit(bytesPerSec float64) error {
+	var err error
+	if math.IsNaN(bytesPerSec) || bytesPerSec < 0 {
+		bytesPerSec, err = 0, ErrInvalidRate
+	}
+
+	global.mu.Lock()
+	defer global.mu.Unlock()
+
+	switch {
+	case bytesPerSec == 0 || bytesPerSec >= MaxRate:
+		if global.limiter != nil {
+			global.limiter.SetRateLimit(0)
+			global.limiter = nil
+		}
+	case global.limiter == nil:
+		global.limiter = NewLimiter(bytesPerSec)
+	default:
+		global.limiter.SetRateLimit(bytesPerSec)
+	}
+	return err
+}
+
+// globalLimiter returns the process-wide limiter, or nil if not set.
+func globalLimiter() *Limiter {
+	global.mu.Lock()
+	defer global.mu.Unlock()
+	return global.limiter
+}
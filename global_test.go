@@ -0,0 +1,64 @@
+package shapeio_test
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSetGlobalRateLimit(t *testing.T) {
+	global := float64(30 * 1024) // 30KB/sec
+	if err := shapeio.SetGlobalRateLimit(global); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shapeio.SetGlobalRateLimit(0) })
+	readers := make([]*shapeio.Reader, 3)
+	for i := range readers {
+		readers[i] = shapeio.NewReader(zeroReader{})
+	}
+
+	n := 15 * 1024
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r *shapeio.Reader) {
+			defer wg.Done()
+			readRate(t, r, n)
+		}(r)
+	}
+	wg.Wait()
+	aggregate := float64(len(readers)*n) / time.Since(start).Seconds()
+	if aggregate > global*1.1 {
+		t.Errorf("aggregate rate %.0f bytes/sec exceeds the global cap %.0f", aggregate, global)
+	}
+	if err := shapeio.SetGlobalRateLimit(0); err != nil {
+		t.Fatal(err)
+	}
+	free := shapeio.NewReader(zeroReader{})
+	if rate := readRate(t, free, 1024*1024); rate < 10*global {
+		t.Errorf("reader created after removing the cap read at %.0f bytes/sec", rate)
+	}
+	if err := shapeio.SetGlobalRateLimit(-1); err != shapeio.ErrInvalidRate {
+		t.Errorf("SetGlobalRateLimit(-1) = %v, want ErrInvalidRate", err)
+	}
+}
+
+func TestSetGlobalRateLimitTry(t *testing.T) {
+	if err := shapeio.SetGlobalRateLimit(1024); err != nil { // 1KB/sec
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shapeio.SetGlobalRateLimit(0) })
+
+	w := shapeio.NewWriter(ioutil.Discard)
+	if n, err := w.TryWrite(make([]byte, 100*1024)); n != 0 || err != shapeio.ErrWouldBlock {
+		t.Errorf("TryWrite = %d, %v under the global cap; want 0, ErrWouldBlock", n, err)
+	}
+	r := shapeio.NewReader(zeroReader{})
+	if n, err := r.TryRead(make([]byte, 100*1024)); n != 0 || err != shapeio.ErrWouldBlock {
+		t.Errorf("TryRead = %d, %v under the global cap; want 0, ErrWouldBlock", n, err)
+	}
+}
@@ -0,0 +1,52 @@
+package shapeio
+
+import "net/http"
+
+// Handler returns a middleware that writes each response body with the rate
+// limit (bytes/sec). The wrapped http.ResponseWriter keeps implementing
+// http.Flusher and http.Hijacker when the original one does. The writer of a
+// response is in the registry (EnableRegistry) until the handler returns.
+func Handler(bytesPerSec float64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := NewWriterWithContext(w, r.Context())
+			defer sw.deregister()
+			sw.SetRateLimit(bytesPerSec)
+			next.ServeHTTP(wrapResponseWriter(w, sw), r)
+		})
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	w *Writer
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	return rw.w.Write(p)
+}
+
+func wrapResponseWriter(w http.ResponseWriter, sw *Writer) http.ResponseWriter {
+	rw := &responseWriter{ResponseWriter: w, w: sw}
+	f, isFlusher := w.(http.Flusher)
+	h, isHijacker := w.(http.Hijacker)
+	switch {
+	case isFlusher && isHijacker:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case isFlusher:
+		return struct {
+			*responseWriter
+			http.Flusher
+		}{rw, f}
+	case isHijacker:
+		return struct {
+			*responseWriter
+			http.Hijacker
+		}{rw, h}
+	}
+	return rw
+}
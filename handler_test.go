@@ -0,0 +1,59 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestHandler(t *testing.T) {
+	limit := float64(200 * 1024) // 200KB/sec
+	body := bytes.Repeat([]byte{0}, 100*1024)
+	h := shapeio.Handler(limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("http.Flusher is not preserved")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("http.Hijacker is not preserved")
+		}
+		w.Write(body)
+	}))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Error("unexpected response body")
+	}
+	realRate := float64(len(b)) / elapsed.Seconds()
+	if realRate > limit {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
+
+func TestHandlerWithoutHijacker(t *testing.T) {
+	h := shapeio.Handler(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("http.Flusher is not preserved")
+		}
+		if _, ok := w.(http.Hijacker); ok {
+			t.Error("http.Hijacker must not be added")
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
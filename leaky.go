@@ -0,0 +1,207 @@
+package shapeio
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// leakInterval is the interval at which the leaky bucket drains.
+const leakInterval = 10 * time.Millisecond
+
+// leakyBucket queues written bytes and drains them to the underlying writer
+// at a constant rate.
+type leakyBucket struct {
+	w        *Writer
+	capacity int
+	lossy    bool
+	flush    bool // flush the queue on cancel
+	queue    []byte
+	dropped  int64
+	err      error
+	closed   bool
+	mu       sync.Mutex
+	cond     *sync.Cond
+	done     chan struct{}
+}
+
+func newLeakyBucket(w *Writer, capacity int) *leakyBucket {
+	b := &leakyBucket{
+		w:        w,
+		capacity: capacity,
+		done:     make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	go b.drain()
+	return b
+}
+
+// write queues p, blocking while the queue is full unless lossy, or until ctx
+// is done.
+func (b *leakyBucket) write(ctx context.Context, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	var stop chan struct{}
+	defer func() {
+		if stop != nil {
+			close(stop)
+		}
+	}()
+	for len(p) > 0 {
+		if b.err != nil {
+			return n, b.err
+		}
+		if b.closed {
+			return n, ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		space := b.capacity - len(b.queue)
+		if space <= 0 {
+			if b.lossy {
+				b.dropped += int64(len(p))
+				return n + len(p), nil
+			}
+			if stop == nil {
+				stop = b.wakeOnDone(ctx)
+			}
+			b.cond.Wait()
+			continue
+		}
+		if space > len(p) {
+			space = len(p)
+		}
+		b.queue = append(b.queue, p[:space]...)
+		p = p[space:]
+		n += space
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// wakeOnDone wakes the waits on b.cond once ctx is done, until the returned
+// channel is closed.
+func (b *leakyBucket) wakeOnDone(ctx context.Context) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+// tryWrite queues p only if it fits in the queue.
+func (b *leakyBucket) tryWrite(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.closed {
+		return 0, ErrClosed
+	}
+	if b.capacity-len(b.queue) < len(p) {
+		return 0, ErrWouldBlock
+	}
+	b.queue = append(b.queue, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *leakyBucket) drain() {
+	defer close(b.done)
+	ctx := b.w.ctx
+	stop := b.wakeOnDone(ctx)
+	defer close(stop)
+	var next time.Time
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 && !b.closed && ctx.Err() == nil {
+			b.cond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			b.cancel(err)
+			return
+		}
+		if len(b.queue) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		limit := b.w.rateLimit()
+		size := len(b.queue)
+		if limit > 0 {
+			if quantum := bytesFor(limit, leakInterval); quantum < size {
+				size = quantum
+			}
+		}
+		chunk := append([]byte(nil), b.queue[:size]...)
+		b.queue = b.queue[size:]
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		if _, err := b.w.write(chunk); err != nil {
+			b.mu.Lock()
+			b.err = err
+			b.queue = nil
+			b.cond.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+		if limit <= 0 {
+			continue
+		}
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+		next = next.Add(time.Duration(float64(size) / limit * float64(time.Second)))
+		t := time.NewTimer(next.Sub(now))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+}
+
+// cancel flushes the queue at once if b.flush, or drops it otherwise, and
+// fails further writes with err. b.mu must be held, and is released.
+func (b *leakyBucket) cancel(err error) {
+	queue := b.queue
+	b.queue = nil
+	if !b.flush {
+		b.dropped += int64(len(queue))
+	}
+	b.err = err
+	flush := b.flush
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	if flush && len(queue) > 0 {
+		b.w.write(queue)
+	}
+}
+
+// close waits until the queue is drained.
+func (b *leakyBucket) close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+	return b.err
+}
+
+func (b *leakyBucket) droppedBytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
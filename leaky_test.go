@@ -0,0 +1,160 @@
+package shapeio_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestLeakyBucket(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	rec := &recordingWriter{}
+	sio := shapeio.NewWriter(rec)
+	sio.SetRateLimit(limit)
+	sio.SetLeakyBucket(20 * 1024)
+
+	// a burst of 60KB is bounded by the queue of 20KB
+	start := time.Now()
+	if n, err := sio.Write(make([]byte, 60*1024)); err != nil || n != 60*1024 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("Write returned too early: %s", elapsed)
+	}
+	if err := sio.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i, size := range rec.sizes {
+		total += size
+		if size > 1024 {
+			t.Errorf("chunk %d has %d bytes, more than 10ms of bandwidth", i, size)
+		}
+	}
+	if total != 60*1024 {
+		t.Errorf("drained %d bytes", total)
+	}
+	// output is smooth: no 100ms span carries more than 10ms extra
+	for i := range rec.times {
+		sum := 0
+		for j := i; j < len(rec.times) && rec.times[j].Sub(rec.times[i]) < 100*time.Millisecond; j++ {
+			sum += rec.sizes[j]
+		}
+		if float64(sum) > limit*0.11 {
+			t.Errorf("%d bytes within 100ms from chunk %d", sum, i)
+			break
+		}
+	}
+}
+
+func TestLeakyBucketLossy(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	sio.SetRateLimit(10 * 1024) // 10KB/sec
+	sio.SetLeakyBucket(1024)
+	sio.SetLossy(true)
+
+	start := time.Now()
+	if n, err := sio.Write(make([]byte, 4*1024)); err != nil || n != 4*1024 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("lossy Write blocked for %s", elapsed)
+	}
+	if d := sio.DroppedBytes(); d != 3*1024 {
+		t.Errorf("dropped %d bytes, expected %d", d, 3*1024)
+	}
+	sio.Close()
+}
+
+func TestLeakyBucketFlushOnCancel(t *testing.T) {
+	for _, flush := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		rec := &recordingWriter{}
+		sio := shapeio.NewWriterWithContext(rec, ctx)
+		sio.SetRateLimit(10 * 1024) // 10KB/sec
+		sio.SetLeakyBucket(64 * 1024)
+		sio.SetFlushOnCancel(flush)
+		if _, err := sio.Write(make([]byte, 20*1024)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		start := time.Now()
+		sio.Close()
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("flush %v: Close after cancel took %s", flush, elapsed)
+		}
+
+		var written int
+		for _, n := range rec.sizes {
+			written += n
+		}
+		dropped := sio.DroppedBytes()
+		if flush && (written != 20*1024 || dropped != 0) {
+			t.Errorf("flushed %d bytes and dropped %d bytes, want all flushed", written, dropped)
+		}
+		if !flush && (written >= 20*1024 || int64(written)+dropped != 20*1024) {
+			t.Errorf("wrote %d bytes and dropped %d bytes without flush", written, dropped)
+		}
+	}
+}
+
+func TestLeakyBucketContext(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	sio.SetRateLimit(1024) // 1KB/sec
+	sio.SetLeakyBucket(1024)
+	sio.SetInitialDelay(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := sio.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Write returned in %s before the initial delay", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := sio.WriteContext(ctx, make([]byte, 10*1024)); err != context.DeadlineExceeded {
+		t.Errorf("WriteContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("WriteContext returned in %s after the deadline", elapsed)
+	}
+}
+
+func TestLeakyBucketDisable(t *testing.T) {
+	rec := &recordingWriter{}
+	sio := shapeio.NewWriter(rec)
+	sio.SetLeakyBucket(0)
+	done := make(chan error, 1)
+	go func() {
+		_, err := sio.Write(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write with SetLeakyBucket(0) blocked")
+	}
+
+	sio.SetLeakyBucket(1024)
+	sio.Write(make([]byte, 20))
+	sio.SetLeakyBucket(0) // drains the queue
+	sio.Write(make([]byte, 30))
+	total := 0
+	for _, size := range rec.sizes {
+		total += size
+	}
+	if total != 60 {
+		t.Errorf("wrote %d bytes, want 60", total)
+	}
+}
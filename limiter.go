@@ -0,0 +1,245 @@
+package shapeio
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// priorityAging is the waiting time to raise the priority of a waiter by one
+// level, so that lower priorities are not starved.
+const priorityAging = 100 * time.Millisecond
+
+// Limiter is a rate limit (bytes/sec) shared by a group of readers and
+// writers set by SetSharedLimiter. When the bandwidth is contended, wrappers
+// with higher priorities acquire it first. A Limiter is safe for concurrent
+// use.
+type Limiter struct {
+	depth int64 // first for 64-bit alignment of atomic operations
+
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	waiters []*limitWaiter
+	seq     int64
+	timer   *time.Timer // pending until the tokens for the next waiter
+
+	// admission of SetMaxConcurrent
+	maxConcurrent int
+	active        int
+	admitQueue    []chan struct{}
+}
+
+type limitWaiter struct {
+	n        int
+	priority int
+	since    time.Time
+	seq      int64
+	ready    chan struct{}
+}
+
+// effectivePriority returns the priority of w aged at now.
+func (w *limitWaiter) effectivePriority(now time.Time) float64 {
+	return float64(w.priority) + float64(now.Sub(w.since))/float64(priorityAging)
+}
+
+// NewLimiter returns a Limiter with rate limit (bytes/sec). Zero or +Inf
+// means no rate limit.
+func NewLimiter(bytesPerSec float64) *Limiter {
+	l := &Limiter{}
+	l.SetRateLimit(bytesPerSec)
+	return l
+}
+
+// SetRateLimit sets rate limit (bytes/sec) to the limiter. Zero, MaxRate
+// or more, and +Inf remove the rate limit. NaN and negative values remove it
+// too, but return ErrInvalidRate.
+func (l *Limiter) SetRateLimit(bytesPerSec float64) error {
+	var err error
+	if math.IsNaN(bytesPerSec) || bytesPerSec < 0 {
+		bytesPerSec, err = 0, ErrInvalidRate
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case bytesPerSec == 0 || bytesPerSec >= MaxRate:
+		l.limiter = nil
+	case l.limiter == nil:
+		l.limiter = newLimiter(bytesPerSec)
+	default:
+		l.limiter.SetLimit(rate.Limit(bytesPerSec))
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.dispatch()
+	return err
+}
+
+// QueueDepth returns the number of operations currently blocked waiting for
+// the bandwidth of the limiter.
+func (l *Limiter) QueueDepth() int {
+	return int(atomic.LoadInt64(&l.depth))
+}
+
+// delay returns the time until n tokens are available at now, regardless of
+// the waiters.
+func (l *Limiter) delay(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limiter == nil {
+		return 0
+	}
+	return tokenDelay(l.limiter.TokensAt(now), float64(l.limiter.Limit()), n)
+}
+
+// allowance returns the tokens available now and those earned over d, or +Inf
+// if not limited.
+func (l *Limiter) allowance(d time.Duration) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limiter == nil || l.limiter.Limit() == rate.Inf {
+		return math.Inf(1)
+	}
+	return l.limiter.TokensAt(time.Now()) + float64(l.limiter.Limit())*d.Seconds()
+}
+
+// dispatch grants tokens to the waiters in the order of effective priority,
+// the earliest one among equals, as long as tokens are available. Otherwise
+// it schedules itself for when the tokens for the next waiter are. l.mu must
+// be held.
+func (l *Limiter) dispatch() {
+	for l.timer == nil && len(l.waiters) > 0 {
+		now := time.Now()
+		next := 0
+		for i, w := range l.waiters[1:] {
+			p, q := w.effectivePriority(now), l.waiters[next].effectivePriority(now)
+			if p > q || p == q && w.seq < l.waiters[next].seq {
+				next = i + 1
+			}
+		}
+		w := l.waiters[next]
+		if l.limiter != nil {
+			if tokens := l.limiter.TokensAt(now); tokens < float64(w.n) {
+				delay := time.Duration((float64(w.n) - tokens) / float64(l.limiter.Limit()) * float64(time.Second))
+				var t *time.Timer
+				t = time.AfterFunc(delay, func() {
+					l.mu.Lock()
+					defer l.mu.Unlock()
+					if l.timer != t {
+						return // stopped meanwhile
+					}
+					l.timer = nil
+					l.dispatch()
+				})
+				l.timer = t
+				return
+			}
+			l.limiter.AllowN(now, w.n)
+		}
+		l.waiters = append(l.waiters[:next], l.waiters[next+1:]...)
+		close(w.ready)
+	}
+}
+
+// wait waits for n tokens in the order of priority.
+func (l *Limiter) wait(ctx context.Context, closed <-chan struct{}, priority int, n int) error {
+	if n > burstLimit {
+		n = burstLimit
+	}
+	l.mu.Lock()
+	l.seq++
+	w := &limitWaiter{
+		n:        n,
+		priority: priority,
+		since:    time.Now(),
+		seq:      l.seq,
+		ready:    make(chan struct{}),
+	}
+	l.waiters = append(l.waiters, w)
+	l.dispatch()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	default:
+	}
+	atomic.AddInt64(&l.depth, 1)
+	defer atomic.AddInt64(&l.depth, -1)
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-closed:
+		err = context.Canceled
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			if l.timer != nil {
+				// the timer may be for w
+				l.timer.Stop()
+				l.timer = nil
+				l.dispatch()
+			}
+			return err
+		}
+	}
+	return err
+}
+
+func (s *shaper) setSharedLimiter(l *Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared = l
+}
+
+func (s *shaper) setPriority(priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.priority = priority
+}
+
+func (s *shaper) setBypassShared(bypass bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bypassShared = bypass
+}
+
+// sharedLimiter returns the shared limiter in effect, and the priority.
+func (s *shaper) sharedLimiter() (*Limiter, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bypassShared {
+		return nil, s.priority
+	}
+	return s.shared, s.priority
+}
+
+// waitShared waits for n tokens of the shared limiter, in the order of
+// priority.
+func (s *shaper) waitShared(ctx context.Context, l *Limiter, priority int, n int) error {
+	if err := s.done(ctx); err != nil {
+		return err
+	}
+	if err := l.wait(ctx, s.closing, priority, n); err != nil {
+		if derr := s.done(ctx); derr != nil {
+			return derr
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package shapeio_test
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSharedLimiterPriority(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	l := shapeio.NewLimiter(limit)
+
+	var wg sync.WaitGroup
+	read := make([]int64, 2)
+	deadline := time.Now().Add(time.Second)
+	for priority := 0; priority < 2; priority++ {
+		sio := shapeio.NewReader(zeroReader{})
+		sio.SetSharedLimiter(l)
+		sio.SetPriority(priority)
+		wg.Add(1)
+		go func(sio io.Reader, n *int64) {
+			defer wg.Done()
+			buf := make([]byte, 4*1024)
+			for time.Now().Before(deadline) {
+				m, err := sio.Read(buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				*n += int64(m)
+			}
+		}(sio, &read[priority])
+	}
+	wg.Wait()
+
+	low, high := read[0], read[1]
+	t.Logf("low %d bytes, high %d bytes", low, high)
+	if low == 0 {
+		t.Error("low priority reader starved")
+	}
+	if float64(high) < float64(low)*1.5 {
+		t.Errorf("high priority reader did not get a larger share: low %d bytes, high %d bytes", low, high)
+	}
+	if total := float64(low + high); total > limit*1.1 {
+		t.Errorf("readers exceeded the shared limit: %f bytes in a second", total)
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	l := shapeio.NewLimiter(1024) // 1KB/sec
+	if n := l.QueueDepth(); n != 0 {
+		t.Fatalf("QueueDepth() = %d at start", n)
+	}
+	readers := make([]*shapeio.Reader, 4)
+	var wg sync.WaitGroup
+	for i := range readers {
+		readers[i] = shapeio.NewReader(zeroReader{})
+		readers[i].SetSharedLimiter(l)
+		wg.Add(1)
+		go func(sio *shapeio.Reader) {
+			defer wg.Done()
+			sio.Read(make([]byte, 1024))
+		}(readers[i])
+	}
+	waitDepth := func(want int) {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			if l.QueueDepth() == want {
+				return
+			}
+		}
+		t.Errorf("QueueDepth() = %d, want %d", l.QueueDepth(), want)
+	}
+	waitDepth(len(readers))
+	for _, sio := range readers {
+		sio.Close()
+	}
+	wg.Wait()
+	waitDepth(0)
+}
+
+func TestCIR(t *testing.T) {
+	committed, peak := float64(50*1024), float64(150*1024)
+	rate := func(excess *shapeio.Limiter) float64 {
+		sio := shapeio.NewReader(zeroReader{})
+		sio.SetSharedLimiter(excess)
+		if err := sio.SetCIR(committed, peak); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4*1024)
+		var total int
+		start := time.Now()
+		for time.Since(start) < 500*time.Millisecond {
+			n, err := sio.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		return float64(total) / time.Since(start).Seconds()
+	}
+
+	if r := rate(shapeio.NewLimiter(1)); r < committed*0.9 || r > committed*1.2 {
+		t.Errorf("rate %f without excess, want the committed rate %f", r, committed)
+	}
+	if r := rate(shapeio.NewLimiter(1024 * 1024)); r < peak*0.9 || r > peak*1.05 {
+		t.Errorf("rate %f with free excess, want the peak rate %f", r, peak)
+	}
+}
+
+// concurrencyReader records the maximum number of concurrent Reads.
+type concurrencyReader struct {
+	mu         *sync.Mutex
+	active     *int
+	maxActive  *int
+	readPeriod time.Duration
+}
+
+func (r concurrencyReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	*r.active++
+	if *r.active > *r.maxActive {
+		*r.maxActive = *r.active
+	}
+	r.mu.Unlock()
+	time.Sleep(r.readPeriod)
+	r.mu.Lock()
+	*r.active--
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	l := shapeio.NewLimiter(0)
+	l.SetMaxConcurrent(2)
+	var mu sync.Mutex
+	var active, maxActive int
+	var wg sync.WaitGroup
+	reads := make([]int, 5)
+	for i := range reads {
+		sio := shapeio.NewReader(concurrencyReader{&mu, &active, &maxActive, 10 * time.Millisecond})
+		sio.SetSharedLimiter(l)
+		wg.Add(1)
+		go func(sio io.Reader, n *int) {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			for i := 0; i < 10; i++ {
+				if _, err := sio.Read(buf); err != nil {
+					t.Error(err)
+					return
+				}
+				*n++
+			}
+		}(sio, &reads[i])
+	}
+	wg.Wait()
+	if maxActive != 2 {
+		t.Errorf("%d transfers in flight, want 2", maxActive)
+	}
+	for i, n := range reads {
+		if n != 10 {
+			t.Errorf("reader %d completed %d reads", i, n)
+		}
+	}
+}
+
+func TestBypassShared(t *testing.T) {
+	l := shapeio.NewLimiter(10 * 1024) // 10KB/sec
+	deadline := time.Now().Add(500 * time.Millisecond)
+
+	// saturate the shared limiter
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		sio := shapeio.NewReader(zeroReader{})
+		sio.SetSharedLimiter(l)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			for time.Now().Before(deadline) {
+				sio.Read(buf)
+			}
+		}()
+	}
+
+	limit := float64(100 * 1024) // 100KB/sec
+	sio := shapeio.NewReader(zeroReader{})
+	sio.SetSharedLimiter(l)
+	sio.SetPriority(-1)
+	sio.SetBypassShared(true)
+	sio.SetRateLimit(limit)
+	buf := make([]byte, 4*1024)
+	var read int
+	start := time.Now()
+	for time.Now().Before(deadline) {
+		n, err := sio.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	realRate := float64(read) / time.Since(start).Seconds()
+	wg.Wait()
+	if realRate > limit*1.05 || realRate < limit*0.8 {
+		t.Errorf("Limit %f but real rate %f of the bypassing reader", limit, realRate)
+	}
+}
+
+func TestSharedLimiterTry(t *testing.T) {
+	shared := shapeio.NewLimiter(1024) // 1KB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetSharedLimiter(shared)
+	if n, err := w.TryWrite(make([]byte, 100*1024)); n != 0 || err != shapeio.ErrWouldBlock {
+		t.Errorf("TryWrite = %d, %v through the shared limiter; want 0, ErrWouldBlock", n, err)
+	}
+	r := shapeio.NewReader(zeroReader{})
+	r.SetSharedLimiter(shared)
+	if n, err := r.TryRead(make([]byte, 100*1024)); n != 0 || err != shapeio.ErrWouldBlock {
+		t.Errorf("TryRead = %d, %v through the shared limiter; want 0, ErrWouldBlock", n, err)
+	}
+
+	// the committed rate alone, with the excess pool exhausted or free
+	for _, c := range []struct {
+		excess *shapeio.Limiter
+		err    error
+	}{
+		{shapeio.NewLimiter(1), shapeio.ErrWouldBlock},
+		{shapeio.NewLimiter(0), nil},
+	} {
+		w := shapeio.NewWriter(ioutil.Discard)
+		w.SetSharedLimiter(c.excess)
+		if err := w.SetCIR(1024, math.Inf(1)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.TryWrite(make([]byte, 100*1024)); err != c.err {
+			t.Errorf("TryWrite = %v under the committed rate, want %v", err, c.err)
+		}
+	}
+}
+
+func TestHighRate(t *testing.T) {
+	limit := float64(4 * 1024 * 1024 * 1024) // 4GB/sec
+	w := newWriter(limit)
+	w.SetCatchUp(true)
+	buf := make([]byte, 1024*1024)
+	start := time.Now()
+	for i := 0; i < 256; i++ {
+		if _, err := w.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 256MB takes 62.5ms at 4GB/sec
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("256MB took %s at 4GB/sec", elapsed)
+	}
+
+	w.SetRateLimit(shapeio.MaxRate)
+	if w.Limiter() != nil {
+		t.Error("MaxRate did not remove the rate limit")
+	}
+}
@@ -0,0 +1,115 @@
+package shapeio
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// LineLimitedReader is an io.Reader that paces the delivery of lines rather
+// than bytes.
+type LineLimitedReader struct {
+	src     io.Reader
+	r       *bufio.Reader
+	limiter *rate.Limiter
+	line    []byte
+	paced   bool // line has been waited for
+	err     error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewLineLimitedReader returns a reader that delivers the newline-terminated
+// lines of r at most linesPerSec lines per second. A partial line at EOF is
+// delivered as a line. Zero or +Inf means no limit.
+func NewLineLimitedReader(r io.Reader, linesPerSec float64) *LineLimitedReader {
+	limit := rate.Limit(linesPerSec)
+	if linesPerSec <= 0 || math.IsNaN(linesPerSec) {
+		limit = rate.Inf
+	}
+	limiter := rate.NewLimiter(limit, 1)
+	limiter.AllowN(time.Now(), 1) // spend initial burst
+	return &LineLimitedReader{
+		src:     r,
+		r:       bufio.NewReader(r),
+		limiter: limiter,
+		done:    make(chan struct{}),
+	}
+}
+
+// Read reads bytes into p, up to the end of the current line.
+func (l *LineLimitedReader) Read(p []byte) (int, error) {
+	return l.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but waits for the line rate until ctx is done.
+// The line waited for is delivered by a later Read.
+func (l *LineLimitedReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if l.isClosed() {
+		return 0, ErrClosed
+	}
+	if len(l.line) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		l.line, l.err = l.r.ReadBytes('\n')
+		l.paced = false
+	}
+	if len(l.line) > 0 && !l.paced {
+		if err := l.wait(ctx); err != nil {
+			return 0, err
+		}
+		l.paced = true
+	}
+	n := copy(p, l.line)
+	l.line = l.line[n:]
+	if len(l.line) == 0 && l.err != nil {
+		return n, l.err
+	}
+	return n, nil
+}
+
+// wait waits for the line rate until ctx is done or the reader is closed.
+func (l *LineLimitedReader) wait(ctx context.Context) error {
+	r := l.limiter.Reserve()
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-l.done:
+		r.Cancel()
+		return ErrClosed
+	}
+}
+
+// Close makes pending and further Reads return ErrClosed, and closes the
+// underlying reader if it implements io.Closer.
+func (l *LineLimitedReader) Close() error {
+	l.once.Do(func() { close(l.done) })
+	if c, ok := l.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (l *LineLimitedReader) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestLineLimitedReader(t *testing.T) {
+	limit := float64(100) // 100 lines/sec
+	src := strings.Repeat("a log line\n", 30) + "partial"
+	r := shapeio.NewLineLimitedReader(strings.NewReader(src), limit)
+	start := time.Now()
+	got, err := ioutil.ReadAll(r)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(src)) {
+		t.Errorf("unexpected data %q", got)
+	}
+	if realRate := 31 / elapsed.Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f lines/sec but real rate %f lines/sec", limit, realRate)
+	}
+}
+
+func TestLineLimitedReaderInterrupt(t *testing.T) {
+	r := shapeio.NewLineLimitedReader(strings.NewReader("a\nb\n"), 0.1) // a line per 10s
+	p := make([]byte, 16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, err := r.ReadContext(ctx, p); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("ReadContext = %d, %v; want 0, %v", n, err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(p)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-errc:
+		if err != shapeio.ErrClosed {
+			t.Errorf("Read = %v after Close, want %v", err, shapeio.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt Read")
+	}
+}
@@ -0,0 +1,69 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MessageWriter is a Writer for message streams, such as websockets, that
+// limits messages per second as well as bytes per second. Each message is
+// written to the underlying writer in a single Write.
+type MessageWriter struct {
+	*Writer
+	messages *rate.Limiter
+}
+
+// NewMessageWriter returns a MessageWriter that writes messages to w at most
+// messagesPerSec messages per second. The byte rate limit is set by
+// SetRateLimit. Zero or +Inf means no limit.
+func NewMessageWriter(w io.Writer, messagesPerSec float64) *MessageWriter {
+	messages := rate.NewLimiter(messageLimit(messagesPerSec), 1)
+	messages.AllowN(time.Now(), 1) // spend initial burst
+	return &MessageWriter{
+		Writer:   NewWriter(w),
+		messages: messages,
+	}
+}
+
+// SetMessageRate sets the message rate limit (messages/sec). Zero or +Inf
+// means no limit.
+func (m *MessageWriter) SetMessageRate(messagesPerSec float64) {
+	m.messages.SetLimit(messageLimit(messagesPerSec))
+}
+
+func messageLimit(messagesPerSec float64) rate.Limit {
+	if messagesPerSec <= 0 || math.IsNaN(messagesPerSec) || math.IsInf(messagesPerSec, 1) {
+		return rate.Inf
+	}
+	return rate.Limit(messagesPerSec)
+}
+
+// WriteMessage writes p as one message, waiting for both the message and the
+// byte rate limits.
+func (m *MessageWriter) WriteMessage(p []byte) error {
+	return m.WriteMessageContext(m.ctx, p)
+}
+
+// WriteMessageContext writes p as one message, waiting for both the message
+// and the byte rate limits with ctx. A message larger than the burst waits
+// for the byte rate limit in burst-sized pieces after it is written.
+func (m *MessageWriter) WriteMessageContext(ctx context.Context, p []byte) error {
+	if err := m.waitStart(ctx); err != nil {
+		return err
+	}
+	if err := m.flushFirst(ctx); err != nil {
+		return err
+	}
+	if err := m.waitLimiter(ctx, m.messages, 1); err != nil {
+		return err
+	}
+	n, err := m.writeContext(ctx, p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
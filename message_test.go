@@ -0,0 +1,101 @@
+package shapeio_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// messageRecorder records the sizes of the Writes.
+type messageRecorder struct {
+	sizes []int
+}
+
+func (r *messageRecorder) Write(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return len(p), nil
+}
+
+func TestMessageWriter(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		messages float64
+		bytes    float64
+		size     int
+		count    int
+	}{
+		{"message rate", 50, 1024 * 1024, 100, 20},
+		{"byte rate", 1000, 40 * 1024, 2 * 1024, 10},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dst := &messageRecorder{}
+			w := shapeio.NewMessageWriter(dst, c.messages)
+			w.SetRateLimit(c.bytes)
+			msg := make([]byte, c.size)
+			start := time.Now()
+			for i := 0; i < c.count; i++ {
+				if err := w.WriteMessage(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			elapsed := time.Since(start).Seconds()
+			if len(dst.sizes) != c.count {
+				t.Fatalf("%d writes for %d messages", len(dst.sizes), c.count)
+			}
+			if realRate := float64(c.count) / elapsed; realRate > c.messages*1.05 {
+				t.Errorf("message limit %f but real rate %f", c.messages, realRate)
+			}
+			if realRate := float64(c.count*c.size) / elapsed; realRate > c.bytes*1.05 {
+				t.Errorf("byte limit %f but real rate %f", c.bytes, realRate)
+			}
+		})
+	}
+}
+
+func TestMessageWriterHugeMessage(t *testing.T) {
+	limit := float64(40 * 1024) // 40KB/sec
+	dst := &messageRecorder{}
+	w := shapeio.NewMessageWriter(dst, 0)
+	w.SetRateLimit(limit)
+	w.SetBurst(1024)
+	start := time.Now()
+	if err := w.WriteMessage(make([]byte, 8*1024)); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if len(dst.sizes) != 1 || dst.sizes[0] != 8*1024 {
+		t.Errorf("message written in %v", dst.sizes)
+	}
+	if elapsed > time.Second {
+		t.Errorf("huge message took %s", elapsed)
+	}
+}
+
+func TestMessageWriterRateChange(t *testing.T) {
+	w := shapeio.NewMessageWriter(&messageRecorder{}, 20)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// changes of the byte rate limit leave the message limit alone
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			w.SetRateLimit(float64(10+i%2) * 1024 * 1024)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := w.WriteMessage([]byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if realRate := 5 / time.Since(start).Seconds(); realRate > 20*1.05 {
+		t.Errorf("message limit 20 but real rate %f while the rate limit changes", realRate)
+	}
+}
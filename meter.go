@@ -0,0 +1,111 @@
+package shapeio
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// rateWindow is the sampling window of CurrentRate and PeakRate.
+const rateWindow = 250 * time.Millisecond
+
+// saturationRatio is the fraction of the rate limit at which a stream is
+// considered saturated.
+const saturationRatio = 0.9
+
+// ErrInvalidSmoothing is returned by SetRateSmoothing for a factor out of
+// (0, 1].
+var ErrInvalidSmoothing = errors.New("shapeio: invalid rate smoothing")
+
+// meter samples throughput over consecutive windows.
+type meter struct {
+	start time.Time
+	bytes int64
+	rate  float64
+	peak  float64
+
+	alpha    float64 // EWMA factor of the samples; zero means 1
+	smoothed float64
+	sampled  bool
+}
+
+// current returns the latest sample, smoothed if enabled.
+func (m *meter) current() float64 {
+	if m.alpha == 0 {
+		return m.rate
+	}
+	return m.smoothed
+}
+
+// add adds n bytes, and reports whether a window has been closed.
+func (m *meter) add(now time.Time, n int) bool {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	rolled := m.roll(now)
+	m.bytes += int64(n)
+	return rolled
+}
+
+// roll closes the current window if it has lasted long enough.
+func (m *meter) roll(now time.Time) bool {
+	if m.start.IsZero() {
+		return false
+	}
+	elapsed := now.Sub(m.start)
+	if elapsed < rateWindow {
+		return false
+	}
+	m.rate = float64(m.bytes) / elapsed.Seconds()
+	if !m.sampled {
+		m.smoothed, m.sampled = m.rate, true
+	} else {
+		m.smoothed += m.alpha * (m.rate - m.smoothed)
+	}
+	if m.rate > m.peak {
+		m.peak = m.rate
+	}
+	m.start = now
+	m.bytes = 0
+	return true
+}
+
+// ioMeter measures the throughput excluding the time spent in the
+// underlying I/O.
+type ioMeter struct {
+	start  time.Time
+	bytes  int64
+	ioTime time.Duration
+}
+
+// add adds n bytes transferred by the underlying I/O from start to end.
+func (m *ioMeter) add(start, end time.Time, n int) {
+	if m.start.IsZero() {
+		m.start = start
+	}
+	m.bytes += int64(n)
+	m.ioTime += end.Sub(start)
+}
+
+// rate returns the throughput (bytes/sec) at now.
+func (m *ioMeter) rate(now time.Time) float64 {
+	elapsed := now.Sub(m.start) - m.ioTime
+	if m.start.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(m.bytes) / elapsed.Seconds()
+}
+
+func (s *shaper) setRateSmoothing(alpha float64) error {
+	if math.IsNaN(alpha) || alpha <= 0 || alpha > 1 {
+		return ErrInvalidSmoothing
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if alpha == 1 {
+		alpha = 0
+	}
+	s.meter.alpha = alpha
+	s.meter.smoothed = s.meter.rate
+	return nil
+}
@@ -0,0 +1,132 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+	"github.com/dustin/go-humanize"
+)
+
+func TestPeakRate(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	sio := shapeio.NewWriter(ioutil.Discard)
+
+	// burst of 1MB before the limit is applied
+	sio.Write(make([]byte, 1024*1024))
+	sio.SetRateLimit(limit)
+	for i := 0; i < 6; i++ {
+		sio.Write(make([]byte, 10*1024))
+	}
+
+	peak := sio.PeakRate()
+	if peak < 10*limit {
+		t.Errorf("PeakRate %f does not reflect the burst", peak)
+	}
+	if current := sio.CurrentRate(); current >= peak {
+		t.Errorf("CurrentRate %f should be below PeakRate %f", current, peak)
+	}
+	t.Logf("peak %s/sec", humanize.IBytes(uint64(peak)))
+
+	sio.Reset()
+	if peak := sio.PeakRate(); peak != 0 {
+		t.Errorf("PeakRate %f after Reset", peak)
+	}
+}
+
+func TestSaturationFunc(t *testing.T) {
+	var fired int32
+	sio := newWriter(100 * 1024) // 100KB/sec
+	sio.SetSaturationFunc(func() {
+		atomic.AddInt32(&fired, 1)
+	})
+	for i := 0; i < 20; i++ { // 80KB for 800ms
+		sio.Write(make([]byte, 4*1024))
+	}
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Errorf("saturation callback fired %d times", n)
+	}
+}
+
+// delayReader sleeps before each Read.
+type delayReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func TestShapedRate(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	// 4KB per 100ms, 40KB/sec
+	src := delayReader{r: bytes.NewReader(make([]byte, 40*1024)), delay: 100 * time.Millisecond}
+	sio := shapeio.NewReader(src)
+	sio.SetRateLimit(limit)
+	buf := make([]byte, 4*1024)
+	var current float64
+	for {
+		_, err := sio.Read(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		current = sio.CurrentRate()
+	}
+	shaped := sio.ShapedRate()
+	t.Logf("shaped rate %f, current rate %f", shaped, current)
+	if shaped < limit*0.8 || shaped > limit*1.1 {
+		t.Errorf("shaped rate %f is not near the limit %f", shaped, limit)
+	}
+	if current > limit*0.5 {
+		t.Errorf("current rate %f is not lowered by the slow source", current)
+	}
+}
+
+func TestSetRateSmoothing(t *testing.T) {
+	raw := shapeio.NewReader(zeroReader{})
+	smooth := shapeio.NewReader(zeroReader{})
+	for _, alpha := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if err := smooth.SetRateSmoothing(alpha); err != shapeio.ErrInvalidSmoothing {
+			t.Errorf("SetRateSmoothing(%f) = %v", alpha, err)
+		}
+	}
+	if err := smooth.SetRateSmoothing(0.2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a steady average rate read in uneven windows
+	window := 260 * time.Millisecond
+	var raws, smooths []float64
+	for i := 0; i < 10; i++ {
+		buf := make([]byte, 10*1024+i%2*20*1024)
+		raw.Read(buf)
+		smooth.Read(buf)
+		time.Sleep(window)
+		raws = append(raws, raw.CurrentRate())
+		smooths = append(smooths, smooth.CurrentRate())
+	}
+
+	mean := float64(20*1024) / window.Seconds()
+	last := smooths[len(smooths)-1]
+	if math.Abs(last-mean) > mean*0.25 {
+		t.Errorf("smoothed rate %f did not converge to %f", last, mean)
+	}
+	variance := func(v []float64) float64 {
+		var sum, sq float64
+		for _, x := range v {
+			sum += x
+		}
+		m := sum / float64(len(v))
+		for _, x := range v {
+			sq += (x - m) * (x - m)
+		}
+		return sq / float64(len(v))
+	}
+	if r, s := variance(raws[5:]), variance(smooths[5:]); s >= r/4 {
+		t.Errorf("smoothed variance %f, raw variance %f", s, r)
+	}
+}
@@ -0,0 +1,59 @@
+package shapeio
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minDuration stretches the reads of a Reader over a minimum duration.
+type minDuration struct {
+	mu      sync.Mutex
+	d       time.Duration
+	start   time.Time
+	limiter *rate.Limiter
+}
+
+// SetMinDuration makes reading the reader to EOF take at least d. If the
+// underlying reader has a Len method, such as *bytes.Reader, the bytes left
+// at the first Read are spread evenly over d; otherwise EOF is held back
+// until d has passed since the first Read. The rate limit of the reader
+// applies as well, so the slower of the two wins.
+func (s *Reader) SetMinDuration(d time.Duration) {
+	s.minDur.mu.Lock()
+	defer s.minDur.mu.Unlock()
+	s.minDur.d = d
+	s.minDur.start = time.Time{}
+	s.minDur.limiter = nil
+}
+
+// startMinDuration starts the minimum duration at the first Read, and returns
+// the limiter spreading the bytes over it, if any.
+func (s *Reader) startMinDuration() *rate.Limiter {
+	s.minDur.mu.Lock()
+	defer s.minDur.mu.Unlock()
+	if s.minDur.d <= 0 || !s.minDur.start.IsZero() {
+		return s.minDur.limiter
+	}
+	s.minDur.start = time.Now()
+	if l, ok := s.r.(interface{ Len() int }); ok && l.Len() > 0 {
+		s.minDur.limiter = newLimiter(float64(l.Len()) / s.minDur.d.Seconds())
+	}
+	return s.minDur.limiter
+}
+
+// holdEOF waits until the minimum duration has passed since the first Read.
+func (s *Reader) holdEOF(ctx context.Context) error {
+	s.minDur.mu.Lock()
+	var remaining time.Duration
+	if s.minDur.d > 0 && !s.minDur.start.IsZero() {
+		remaining = s.minDur.start.Add(s.minDur.d).Sub(time.Now())
+	}
+	s.minDur.mu.Unlock()
+	if remaining <= 0 {
+		return nil
+	}
+	return s.sleep(ctx, remaining)
+}
@@ -0,0 +1,49 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSetMinDuration(t *testing.T) {
+	d := 200 * time.Millisecond
+	for _, c := range []struct {
+		name string
+		r    func() io.Reader
+	}{
+		{"known size", func() io.Reader { return bytes.NewReader(make([]byte, 100)) }},
+		{"unknown size", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(make([]byte, 100))} }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sio := shapeio.NewReader(c.r())
+			sio.SetMinDuration(d)
+			start := time.Now()
+			b, err := ioutil.ReadAll(sio)
+			elapsed := time.Since(start)
+			if err != nil || len(b) != 100 {
+				t.Fatalf("read %d bytes, %v", len(b), err)
+			}
+			if elapsed < d || elapsed > d+100*time.Millisecond {
+				t.Errorf("copy took %s, want at least %s", elapsed, d)
+			}
+		})
+	}
+
+	// the rate limit wins if slower
+	limit := float64(10 * 1024) // 10KB/sec
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 4*1024)))
+	sio.SetRateLimit(limit)
+	sio.SetMinDuration(d)
+	start := time.Now()
+	if _, err := ioutil.ReadAll(sio); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("copy took %s under the rate limit", elapsed)
+	}
+}
@@ -0,0 +1,39 @@
+package shapeio
+
+import "time"
+
+// Option configures a Reader or Writer at construction.
+type Option func(s *shaper)
+
+// Clock is the time source of the rate limiting of a wrapper, such as a fake
+// clock for deterministic tests. Wait waits for d on the clock, and serves as
+// the WaitStrategy unless another one is set by SetWaitStrategy.
+type Clock interface {
+	Now() time.Time
+	WaitStrategy
+}
+
+// WithClock makes the wrapper account the tokens of its own rate limit, and
+// wait for them, by c instead of the real clock. The statistics, the shared
+// Limiter and the other limits keep the real clock.
+func WithClock(c Clock) Option {
+	return func(s *shaper) {
+		s.clock = c
+	}
+}
+
+// WithController overrides the built-in token bucket of the wrapper, which it
+// waits for by default, with c, as SetRateController does.
+func WithController(c RateController) Option {
+	return func(s *shaper) {
+		s.controller = c
+	}
+}
+
+// now returns the time of the clock.
+func (s *shaper) now() time.Time {
+	if s.clock != nil {
+		return s.clock.Now()
+	}
+	return time.Now()
+}
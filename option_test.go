@@ -0,0 +1,109 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// fakeClock is a Clock that advances instantly on Wait.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Wait(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func ExampleWithClock() {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	w := shapeio.NewWriter(ioutil.Discard, shapeio.WithClock(clock))
+	w.SetRateLimit(1024) // 1KB/sec
+	w.SetBurst(1024)
+
+	start := clock.Now()
+	w.Write(make([]byte, 10*1024)) // returns at once
+	fmt.Println(clock.Now().Sub(start))
+	// Output: 10s
+}
+
+// clockController transfers bytes at a fixed rate on a fake clock.
+type clockController struct {
+	clock *fakeClock
+	rate  float64
+}
+
+func (c *clockController) WaitN(ctx context.Context, n int) error {
+	return c.clock.Wait(ctx, time.Duration(float64(n)/c.rate*float64(time.Second)))
+}
+
+func (c *clockController) AllowN(now time.Time, n int) bool { return false }
+func (c *clockController) SetRate(bytesPerSec float64)      { c.rate = bytesPerSec }
+func (c *clockController) Tokens() float64                  { return 0 }
+
+func TestWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 64*1024)), shapeio.WithClock(clock))
+	sio.SetRateLimit(16 * 1024) // 16KB/sec
+	sio.SetBurst(4 * 1024)
+	start := time.Now()
+	if _, err := ioutil.ReadAll(sio); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("fake clock waited %s in real time", elapsed)
+	}
+	if d := clock.Now().Sub(time.Unix(0, 0)); d != 4*time.Second {
+		t.Errorf("fake clock advanced %s, want 4s", d)
+	}
+}
+
+func TestWithClockReserve(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	w := shapeio.NewWriter(ioutil.Discard, shapeio.WithClock(clock))
+	w.SetRateLimit(1024) // 1KB/sec
+	if d, _ := w.Reserve(10 * 1024); d != 10*time.Second {
+		t.Errorf("Reserve(10KB) = %s on the fake clock, want 10s", d)
+	}
+	clock.now = clock.now.Add(10 * time.Second)
+	if _, err := w.TryWrite(make([]byte, 512)); err == nil {
+		t.Error("TryWrite succeeded on tokens taken by Reserve")
+	}
+}
+
+func TestWithController(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := &clockController{clock: clock}
+	w := shapeio.NewWriter(ioutil.Discard, shapeio.WithClock(clock), shapeio.WithController(c))
+	w.SetRateLimit(2 * 1024) // 2KB/sec
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := clock.Now().Sub(time.Unix(0, 0)); d != 1500*time.Millisecond {
+		t.Errorf("fake clock advanced %s, want 1.5s", d)
+	}
+	if _, err := w.TryWrite(make([]byte, 1024)); err != shapeio.ErrWouldBlock {
+		t.Errorf("TryWrite() = %v, want %v", err, shapeio.ErrWouldBlock)
+	}
+}
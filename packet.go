@@ -0,0 +1,49 @@
+package shapeio
+
+import "math"
+
+func (s *shaper) setPacketModel(mtu, overhead int) {
+	if mtu <= 0 {
+		mtu, overhead = 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mtu = mtu
+	s.overhead = overhead
+}
+
+// chunkSize returns the maximum bytes transferred at once, the burst or the
+// MTU if smaller.
+func (s *shaper) chunkSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.burstSize(); s.mtu == 0 || n < s.mtu {
+		return n
+	}
+	return s.mtu
+}
+
+// packetOverhead returns the overhead of the packets transferring n bytes.
+func (s *shaper) packetOverhead(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mtu == 0 || n <= 0 {
+		return 0
+	}
+	packets := (n + s.mtu - 1) / s.mtu
+	return packets * s.overhead
+}
+
+// payloadFor returns the bytes whose packets, with their overhead, fit in n
+// bytes.
+func (s *shaper) payloadFor(n float64) float64 {
+	s.mu.Lock()
+	mtu, overhead := float64(s.mtu), float64(s.overhead)
+	s.mu.Unlock()
+	if mtu == 0 || overhead <= 0 {
+		return n
+	}
+	packets := math.Floor(n / (mtu + overhead))
+	rest := n - packets*(mtu+overhead) - overhead
+	return packets*mtu + math.Max(rest, 0)
+}
@@ -0,0 +1,44 @@
+package shapeio_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestPacketModel(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec link
+	mtu := 1500
+	goodput := func(size int) float64 {
+		rec := &recordingWriter{}
+		sio := shapeio.NewWriter(rec)
+		sio.SetRateLimit(limit)
+		sio.SetPacketModel(mtu, 100)
+		payload := make([]byte, size)
+		start := time.Now()
+		var total int
+		for total < 20*1024 {
+			n, err := sio.Write(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		elapsed := time.Since(start)
+		for _, n := range rec.sizes {
+			if n > mtu {
+				t.Fatalf("wrote %d bytes at once, exceeding the MTU", n)
+			}
+		}
+		return float64(total) / elapsed.Seconds()
+	}
+	small, large := goodput(100), goodput(15000)
+	t.Logf("goodput %f bytes/sec for small payloads, %f bytes/sec for large ones", small, large)
+	if small > large*0.7 {
+		t.Errorf("small payloads achieved goodput %f comparable to large ones %f", small, large)
+	}
+	if large > limit {
+		t.Errorf("goodput %f exceeds the link rate %f", large, limit)
+	}
+}
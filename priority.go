@@ -0,0 +1,100 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// controlPriority is the priority of control data over bulk data in a
+// PriorityWriter. Bulk data waiting for a second outranks fresh control data,
+// so that it is not starved.
+const controlPriority = 10
+
+// defaultPriorityChunk is the default piece of bulk data of a PriorityWriter,
+// between which control data may be written.
+const defaultPriorityChunk = 4096
+
+// PriorityWriter is a Writer carrying both control and bulk data in one
+// stream under a rate limit. Control data written by WriteControl preempts the
+// bulk data written by Write: it is written between the pieces of a pending
+// bulk Write, and acquires the bandwidth first, while bulk data still makes
+// progress. The methods of Writer apply to bulk data, except SetRateLimit,
+// which limits the whole stream. SetBurst sets the piece of bulk data,
+// 4096 bytes by default.
+type PriorityWriter struct {
+	*Writer
+	control *Writer
+	limiter *Limiter
+	w       io.Writer
+}
+
+// NewPriorityWriter returns a PriorityWriter that writes to w at most
+// bytesPerSec bytes per second. Zero or +Inf means no rate limit.
+func NewPriorityWriter(w io.Writer, bytesPerSec float64) *PriorityWriter {
+	sink := &prioritySink{w: w}
+	limiter := NewLimiter(bytesPerSec)
+	bulk := NewWriter(sink)
+	bulk.SetSharedLimiter(limiter)
+	bulk.SetBurst(defaultPriorityChunk)
+	control := NewWriter(sink)
+	control.SetSharedLimiter(limiter)
+	control.SetPriority(controlPriority)
+	return &PriorityWriter{
+		Writer:  bulk,
+		control: control,
+		limiter: limiter,
+		w:       w,
+	}
+}
+
+// SetRateLimit sets rate limit (bytes/sec) to the whole stream, control and
+// bulk data together, as Limiter.SetRateLimit does.
+func (p *PriorityWriter) SetRateLimit(bytesPerSec float64) {
+	p.limiter.SetRateLimit(bytesPerSec)
+}
+
+// SetRateLimitErr is like SetRateLimit, but returns ErrInvalidRate for NaN
+// and negative values.
+func (p *PriorityWriter) SetRateLimitErr(bytesPerSec float64) error {
+	return p.limiter.SetRateLimit(bytesPerSec)
+}
+
+// WriteControl writes b as control data, ahead of the pending bulk data.
+func (p *PriorityWriter) WriteControl(b []byte) (int, error) {
+	return p.control.Write(b)
+}
+
+// WriteControlContext writes b as control data, ahead of the pending bulk
+// data, waiting for the rate limit with ctx.
+func (p *PriorityWriter) WriteControlContext(ctx context.Context, b []byte) (int, error) {
+	return p.control.WriteContext(ctx, b)
+}
+
+// Close makes pending and further writes of both control and bulk data return
+// ErrClosed, and closes the underlying writer if it implements io.Closer.
+func (p *PriorityWriter) Close() error {
+	err := p.control.Close()
+	if berr := p.Writer.Close(); err == nil {
+		err = berr
+	}
+	if c, ok := p.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// prioritySink serializes the writes of control and bulk data to the
+// underlying writer.
+type prioritySink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *prioritySink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
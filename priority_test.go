@@ -0,0 +1,72 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// recorder records the writes to it.
+type recorder struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestPriorityWriter(t *testing.T) {
+	var rec recorder
+	w := shapeio.NewPriorityWriter(&rec, 10*1024) // 10KB/sec
+	w.SetBurst(1024)
+
+	bulk := bytes.Repeat([]byte("b"), 8*1024) // 800ms
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(bulk)
+		done <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if _, err := w.WriteControl([]byte("CTRL")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("control write took %s", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var before, after int
+	var seen bool
+	for _, p := range rec.writes {
+		switch {
+		case string(p) == "CTRL":
+			seen = true
+		case seen:
+			after += len(p)
+		default:
+			before += len(p)
+		}
+	}
+	if !seen {
+		t.Fatal("control frame not written")
+	}
+	if before+after != len(bulk) {
+		t.Errorf("%d bulk bytes written; want %d", before+after, len(bulk))
+	}
+	if after < len(bulk)/2 {
+		t.Errorf("control frame written after %d bulk bytes; want ahead of the pending %d", before, len(bulk)-before)
+	}
+}
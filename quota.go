@@ -0,0 +1,162 @@
+package shapeio
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when the daily quota set by SetQuotaStore has
+// been consumed.
+var ErrQuotaExceeded = errors.New("shapeio: quota exceeded")
+
+// quotaSaveInterval is the interval to persist consumed bytes to QuotaStore.
+const quotaSaveInterval = time.Second
+
+// QuotaStore persists the bytes consumed against a daily quota, so the quota
+// survives process restarts.
+type QuotaStore interface {
+	// Load returns the bytes consumed today.
+	Load() int64
+	// Save stores the bytes consumed today.
+	Save(consumed int64)
+}
+
+type quota struct {
+	store QuotaStore
+	limit int64
+	used  int64
+	day   string
+	saved time.Time
+	dirty bool // used is not saved
+}
+
+func today(now time.Time) string {
+	return now.Format("2006-01-02")
+}
+
+// allowance returns how many of n bytes may be transferred today.
+func (q *quota) allowance(now time.Time, n int) int {
+	if day := today(now); day != q.day {
+		q.day = day
+		q.used = 0
+	}
+	if remaining := q.limit - q.used; remaining < int64(n) {
+		if remaining < 0 {
+			return 0
+		}
+		return int(remaining)
+	}
+	return n
+}
+
+// consume adds n bytes and reports whether they should be saved now.
+func (q *quota) consume(now time.Time, n int) bool {
+	q.used += int64(n)
+	if now.Sub(q.saved) < quotaSaveInterval && q.used < q.limit {
+		q.dirty = true
+		return false
+	}
+	q.saved = now
+	q.dirty = false
+	return true
+}
+
+func (s *shaper) setQuotaStore(store QuotaStore, dailyLimit int64) {
+	now := time.Now()
+	q := &quota{
+		store: store,
+		limit: dailyLimit,
+		used:  store.Load(),
+		day:   today(now),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quota = q
+}
+
+// saveQuota saves the consumed bytes not saved yet, such as on Close.
+func (s *shaper) saveQuota() {
+	s.mu.Lock()
+	q := s.quota
+	if q == nil || !q.dirty {
+		s.mu.Unlock()
+		return
+	}
+	q.saved = time.Now()
+	q.dirty = false
+	used := q.used
+	s.mu.Unlock()
+	q.store.Save(used)
+}
+
+// quotaAllowance returns how many of n bytes the quota allows.
+func (s *shaper) quotaAllowance(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota == nil {
+		return n
+	}
+	return s.quota.allowance(time.Now(), n)
+}
+
+// FileQuotaStore is a QuotaStore backed by a file.
+// The file is replaced atomically on each Save.
+type FileQuotaStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileQuotaStore returns a FileQuotaStore that stores to path.
+func NewFileQuotaStore(path string) *FileQuotaStore {
+	return &FileQuotaStore{path: path}
+}
+
+// Load returns the bytes consumed today, or 0 if the file is missing,
+// unreadable or was saved on another day.
+func (f *FileQuotaStore) Load() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return 0
+	}
+	var day string
+	var consumed int64
+	if _, err := fmt.Sscanf(string(b), "%s %d", &day, &consumed); err != nil {
+		return 0
+	}
+	if day != today(time.Now()) {
+		return 0
+	}
+	return consumed
+}
+
+// Save stores the bytes consumed today.
+func (f *FileQuotaStore) Save(consumed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%s %d\n", today(time.Now()), consumed); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), f.path)
+}
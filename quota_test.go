@@ -0,0 +1,98 @@
+package shapeio_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cryks/shapeio"
+)
+
+type memQuotaStore struct {
+	mu       sync.Mutex
+	consumed int64
+}
+
+func (m *memQuotaStore) Load() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.consumed
+}
+
+func (m *memQuotaStore) Save(consumed int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumed = consumed
+}
+
+func TestQuotaStore(t *testing.T) {
+	store := &memQuotaStore{}
+	dailyLimit := int64(100 * 1024) // 100KB/day
+
+	sio := shapeio.NewWriter(ioutil.Discard)
+	sio.SetQuotaStore(store, dailyLimit)
+	if _, err := sio.Write(make([]byte, 60*1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulated restart
+	sio = shapeio.NewWriter(ioutil.Discard)
+	sio.SetQuotaStore(store, dailyLimit)
+	n, err := sio.Write(make([]byte, 60*1024))
+	if n != 40*1024 {
+		t.Errorf("expected to write the remaining 40KB, wrote %d", n)
+	}
+	if err != shapeio.ErrQuotaExceeded {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := sio.Write([]byte{0}); err != shapeio.ErrQuotaExceeded {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if c := store.Load(); c != dailyLimit {
+		t.Errorf("stored %d, expected %d", c, dailyLimit)
+	}
+}
+
+func TestQuotaStoreSaveOnClose(t *testing.T) {
+	store := &memQuotaStore{}
+	dailyLimit := int64(100 * 1024) // 100KB/day
+
+	sio := shapeio.NewWriter(ioutil.Discard)
+	sio.SetQuotaStore(store, dailyLimit)
+	// the second write is within the save interval
+	sio.Write(make([]byte, 10*1024))
+	sio.Write(make([]byte, 20*1024))
+	if err := sio.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c := store.Load(); c != 30*1024 {
+		t.Errorf("stored %d on Close, expected %d", c, 30*1024)
+	}
+
+	// simulated clean restart
+	sio = shapeio.NewWriter(ioutil.Discard)
+	sio.SetQuotaStore(store, dailyLimit)
+	if n, _ := sio.Write(make([]byte, 100*1024)); n != 70*1024 {
+		t.Errorf("expected to write the remaining 70KB, wrote %d", n)
+	}
+}
+
+func TestFileQuotaStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapeio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "quota")
+	store := shapeio.NewFileQuotaStore(path)
+	if c := store.Load(); c != 0 {
+		t.Errorf("Load returned %d without a file", c)
+	}
+	store.Save(12345)
+	if c := shapeio.NewFileQuotaStore(path).Load(); c != 12345 {
+		t.Errorf("Load returned %d, expected 12345", c)
+	}
+}
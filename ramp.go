@@ -0,0 +1,21 @@
+package shapeio
+
+import "time"
+
+// ramp moves the rate limit linearly between two values over a duration.
+type ramp struct {
+	from     float64
+	to       float64
+	start    time.Time
+	duration time.Duration
+}
+
+// at returns the rate limit at now, and whether the ramp has finished.
+func (r *ramp) at(now time.Time) (float64, bool) {
+	elapsed := now.Sub(r.start)
+	if elapsed >= r.duration {
+		return r.to, true
+	}
+	f := float64(elapsed) / float64(r.duration)
+	return r.from + (r.to-r.from)*f, false
+}
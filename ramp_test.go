@@ -0,0 +1,44 @@
+package shapeio_test
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampDuration(t *testing.T) {
+	sio := newWriter(1024 * 1024) // 1MB/sec
+	sio.SetRampDuration(time.Second)
+	sio.SetRateLimit(100 * 1024) // 100KB/sec
+
+	// average rates over [0, 300ms), [400ms, 700ms) and after 1s
+	var written [3]int
+	var spent [3]time.Duration
+	start := time.Now()
+	for time.Since(start) < 1300*time.Millisecond {
+		at := time.Since(start)
+		sio.Write(make([]byte, 4*1024))
+		d := time.Since(start) - at
+		switch {
+		case at < 300*time.Millisecond:
+			written[0], spent[0] = written[0]+4*1024, spent[0]+d
+		case at >= 400*time.Millisecond && at < 700*time.Millisecond:
+			written[1], spent[1] = written[1]+4*1024, spent[1]+d
+		case at >= time.Second:
+			written[2], spent[2] = written[2]+4*1024, spent[2]+d
+		}
+	}
+	var rates [3]float64
+	for i := range rates {
+		rates[i] = float64(written[i]) / spent[i].Seconds()
+	}
+	t.Logf("rates %v", rates)
+	if !(rates[0] > rates[1] && rates[1] > rates[2]) {
+		t.Errorf("rate did not decrease gradually: %v", rates)
+	}
+	if rates[1] < 200*1024 {
+		t.Errorf("rate stepped down without ramp: %v", rates)
+	}
+	if rates[2] > 120*1024 {
+		t.Errorf("rate did not reach the new limit: %v", rates)
+	}
+}
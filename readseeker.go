@@ -0,0 +1,47 @@
+package shapeio
+
+import "io"
+
+// ReadSeeker is a Reader that also implements io.Seeker, e.g. for
+// http.ServeContent. Seek is passed through without rate limiting.
+type ReadSeeker struct {
+	*Reader
+	seeker io.Seeker
+}
+
+// NewReadSeeker returns a reader that implements io.ReadSeeker with rate
+// limit (bytes/sec) on Read. As for the other readers, Close removes it from
+// the registry (EnableRegistry); Deregister does so without closing rs.
+func NewReadSeeker(rs io.ReadSeeker, bytesPerSec float64) *ReadSeeker {
+	r := NewReader(rs)
+	r.SetRateLimit(bytesPerSec)
+	return &ReadSeeker{
+		Reader: r,
+		seeker: rs,
+	}
+}
+
+// Deregister removes the reader from the registry (EnableRegistry) without
+// closing it, such as once http.ServeContent returns.
+func (s *ReadSeeker) Deregister() {
+	s.deregister()
+}
+
+// Seek sets the offset for the next Read. It drops the bytes buffered by
+// SetMinReadSize, which io.SeekCurrent counts as not read yet, and waits for
+// a Read in progress.
+func (s *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	if whence == io.SeekCurrent {
+		offset -= int64(len(s.buf))
+	}
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	pos, err := s.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	s.buf, s.bufErr = s.buf[:0], nil
+	return pos, nil
+}
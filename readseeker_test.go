@@ -0,0 +1,59 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestReadSeekerServeContent(t *testing.T) {
+	limit := float64(200 * 1024) // 200KB/sec
+	content := make([]byte, 256*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	rs := shapeio.NewReadSeeker(bytes.NewReader(content), limit)
+
+	req := httptest.NewRequest("GET", "/file", nil)
+	req.Header.Set("Range", "bytes=1000-103399")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	http.ServeContent(rec, req, "file", time.Time{}, rs)
+	elapsed := time.Since(start)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	body := rec.Body.Bytes()
+	if !bytes.Equal(body, content[1000:103400]) {
+		t.Error("unexpected range content")
+	}
+	realRate := float64(len(body)) / elapsed.Seconds()
+	if realRate > limit {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
+
+func TestReadSeekerSeekBuffered(t *testing.T) {
+	rs := shapeio.NewReadSeeker(bytes.NewReader([]byte("abcdefghijklmnop")), 0)
+	rs.SetMinReadSize(8)
+	p := make([]byte, 2)
+	if _, err := rs.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	// the buffered bytes are not read yet
+	if pos, err := rs.Seek(0, io.SeekCurrent); pos != 2 || err != nil {
+		t.Errorf("Seek(0, io.SeekCurrent) = %d, %v; want 2, nil", pos, err)
+	}
+	if _, err := rs.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rs.Read(p); err != nil || string(p[:n]) != "kl" {
+		t.Errorf("Read = %q, %v after Seek; want \"kl\", nil", p[:n], err)
+	}
+}
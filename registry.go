@@ -0,0 +1,89 @@
+package shapeio
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// registry is the set of live wrappers, kept once EnableRegistry is called.
+var registry struct {
+	enabled int32
+	mu      sync.Mutex
+	shapers map[*shaper]struct{}
+}
+
+// Stats is the statistics of a wrapper in the registry.
+type Stats struct {
+	// Label is the label set by SetLabel.
+	Label string
+	Summary
+}
+
+// EnableRegistry makes the wrappers constructed from now on register
+// themselves in a process-wide registry until closed, for Snapshot. A wrapper
+// never closed stays registered, and so is never garbage collected. The
+// registry costs nothing until enabled.
+func EnableRegistry() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.shapers == nil {
+		registry.shapers = make(map[*shaper]struct{})
+	}
+	atomic.StoreInt32(&registry.enabled, 1)
+}
+
+// Snapshot returns the statistics of the wrappers in the registry, in the
+// order of construction. The wrappers are registered only once
+// EnableRegistry is called.
+func Snapshot() []Stats {
+	if atomic.LoadInt32(&registry.enabled) == 0 {
+		return nil
+	}
+	registry.mu.Lock()
+	shapers := make([]*shaper, 0, len(registry.shapers))
+	for s := range registry.shapers {
+		shapers = append(shapers, s)
+	}
+	registry.mu.Unlock()
+	sort.Slice(shapers, func(i, j int) bool {
+		return shapers[i].created.Before(shapers[j].created)
+	})
+	stats := make([]Stats, len(shapers))
+	for i, s := range shapers {
+		stats[i] = Stats{Label: s.getLabel(), Summary: s.summary()}
+	}
+	return stats
+}
+
+// register adds s to the registry if enabled.
+func (s *shaper) register() {
+	if atomic.LoadInt32(&registry.enabled) == 0 {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.shapers[s] = struct{}{}
+}
+
+// deregister removes s from the registry.
+func (s *shaper) deregister() {
+	if atomic.LoadInt32(&registry.enabled) == 0 {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.shapers, s)
+}
+
+func (s *shaper) setLabel(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label = label
+}
+
+func (s *shaper) getLabel() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.label
+}
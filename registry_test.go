@@ -0,0 +1,77 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cryks/shapeio"
+)
+
+func labels(stats []shapeio.Stats) map[string]int64 {
+	m := make(map[string]int64)
+	for _, st := range stats {
+		m[st.Label] = st.Total
+	}
+	return m
+}
+
+func TestRegistry(t *testing.T) {
+	shapeio.EnableRegistry()
+
+	r := shapeio.NewReader(bytes.NewReader(make([]byte, 100)))
+	r.SetLabel("registry-reader")
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetLabel("registry-writer")
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	m := labels(shapeio.Snapshot())
+	if total, ok := m["registry-reader"]; !ok || total != 100 {
+		t.Errorf("reader: registered %v, total %d", ok, total)
+	}
+	if _, ok := m["registry-writer"]; !ok {
+		t.Error("writer not registered")
+	}
+
+	r.Close()
+	m = labels(shapeio.Snapshot())
+	if _, ok := m["registry-reader"]; ok {
+		t.Error("closed reader still registered")
+	}
+	if _, ok := m["registry-writer"]; !ok {
+		t.Error("writer not registered")
+	}
+
+	w.Close()
+	if _, ok := labels(shapeio.Snapshot())["registry-writer"]; ok {
+		t.Error("closed writer still registered")
+	}
+}
+
+func TestRegistryInternalWrappers(t *testing.T) {
+	shapeio.EnableRegistry()
+	size := len(shapeio.Snapshot())
+
+	h := shapeio.Handler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(shapeio.Snapshot()); n != size+1 {
+			t.Errorf("%d wrappers registered while serving, want %d", n, size+1)
+		}
+		w.Write([]byte("hello"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := len(shapeio.Snapshot()); n != size {
+		t.Errorf("%d wrappers registered after serving, want %d", n, size)
+	}
+
+	shapeio.WriteAtRate(ioutil.Discard, make([]byte, 10), 0)
+	shapeio.CopyWithPolicy(ioutil.Discard, bytes.NewReader(make([]byte, 10)), shapeio.Policy{})
+	rs := shapeio.NewReadSeeker(bytes.NewReader(make([]byte, 10)), 0)
+	rs.Deregister()
+	if n := len(shapeio.Snapshot()); n != size {
+		t.Errorf("%d wrappers registered after WriteAtRate, CopyWithPolicy and NewReadSeeker, want %d", n, size)
+	}
+}
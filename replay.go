@@ -0,0 +1,143 @@
+package shapeio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record is the offset and time of a chunk written to a RecordingWriter.
+type Record struct {
+	Offset  int64         // offset of the chunk in the stream
+	Elapsed time.Duration // time since the first chunk was written
+}
+
+// RecordingWriter is an io.Writer that records the offset and time of each
+// Write, to be replayed by ReplayReader.
+type RecordingWriter struct {
+	w       io.Writer
+	start   time.Time
+	offset  int64
+	records []Record
+	mu      sync.Mutex
+}
+
+// NewRecordingWriter returns a RecordingWriter that writes to w.
+func NewRecordingWriter(w io.Writer) *RecordingWriter {
+	return &RecordingWriter{w: w}
+}
+
+// Write writes the chunk to the underlying writer, and records it if any of
+// it is written.
+func (s *RecordingWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	n, err := s.w.Write(p)
+	if n > 0 {
+		if s.start.IsZero() {
+			s.start = now
+		}
+		s.records = append(s.records, Record{Offset: s.offset, Elapsed: now.Sub(s.start)})
+		s.offset += int64(n)
+	}
+	return n, err
+}
+
+// Records returns the records of the chunks written so far.
+func (s *RecordingWriter) Records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Record(nil), s.records...)
+}
+
+// ReplayReader is an io.Reader that delivers the data of r at the timing of
+// records, as recorded by RecordingWriter. Wrap it with NewReader to replay
+// under a rate limit too.
+type ReplayReader struct {
+	r       io.Reader
+	records []Record
+	start   time.Time
+	offset  int64
+	i       int
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewReplayReader returns a ReplayReader that reads from r.
+func NewReplayReader(r io.Reader, records []Record) *ReplayReader {
+	return &ReplayReader{
+		r:       r,
+		records: records,
+		done:    make(chan struct{}),
+	}
+}
+
+// Read reads bytes into p, waiting until the chunk they belong to is due.
+// A Read never returns bytes across chunks.
+func (s *ReplayReader) Read(p []byte) (int, error) {
+	return s.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read, but waits for the chunk until ctx is done.
+func (s *ReplayReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	for s.i+1 < len(s.records) && s.records[s.i+1].Offset <= s.offset {
+		s.i++
+	}
+	if s.i < len(s.records) {
+		if d := s.start.Add(s.records[s.i].Elapsed).Sub(time.Now()); d > 0 {
+			if err := s.sleep(ctx, d); err != nil {
+				return 0, err
+			}
+		}
+		if s.i+1 < len(s.records) {
+			if remaining := s.records[s.i+1].Offset - s.offset; remaining < int64(len(p)) {
+				p = p[:remaining]
+			}
+		}
+	}
+	n, err := s.r.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+// sleep waits for d until ctx is done or the reader is closed.
+func (s *ReplayReader) sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return ErrClosed
+	}
+}
+
+// Close makes pending and further Reads return ErrClosed, and closes the
+// underlying reader if it implements io.Closer.
+func (s *ReplayReader) Close() error {
+	s.once.Do(func() { close(s.done) })
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *ReplayReader) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	rec := shapeio.NewRecordingWriter(&buf)
+	rec.Write([]byte("aaaa"))
+	time.Sleep(100 * time.Millisecond)
+	rec.Write([]byte("bbbb"))
+	time.Sleep(200 * time.Millisecond)
+	rec.Write([]byte("cc"))
+
+	records := rec.Records()
+	if len(records) != 3 || records[1].Offset != 4 || records[2].Offset != 8 {
+		t.Fatalf("unexpected records %v", records)
+	}
+
+	rr := shapeio.NewReplayReader(&buf, records)
+	var chunks []string
+	var times []time.Time
+	p := make([]byte, 16)
+	for {
+		n, err := rr.Read(p)
+		if n > 0 {
+			chunks = append(chunks, string(p[:n]))
+			times = append(times, time.Now())
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"aaaa", "bbbb", "cc"}
+	if len(chunks) != len(expected) {
+		t.Fatalf("unexpected chunks %q", chunks)
+	}
+	for i, c := range expected {
+		if chunks[i] != c {
+			t.Errorf("chunk %d is %q, expected %q", i, chunks[i], c)
+		}
+		if i == 0 {
+			continue
+		}
+		gap := times[i].Sub(times[i-1])
+		recorded := records[i].Elapsed - records[i-1].Elapsed
+		if gap < recorded-10*time.Millisecond || gap > recorded+50*time.Millisecond {
+			t.Errorf("chunk %d replayed after %s, recorded %s", i, gap, recorded)
+		}
+	}
+}
+
+func TestRecordingWriterFailure(t *testing.T) {
+	errFlaky := errors.New("flaky link")
+	var buf bytes.Buffer
+	w := shapeio.NewWriter(&buf)
+	rec := shapeio.NewRecordingWriter(w)
+	rec.Write([]byte("aaaa"))
+	w.SetFailureRate(1, errFlaky)
+	if n, err := rec.Write([]byte("bbbb")); n != 0 || err != errFlaky {
+		t.Fatalf("Write = %d, %v; want 0, %v", n, err, errFlaky)
+	}
+	w.SetFailureRate(0, nil)
+	rec.Write([]byte("cc"))
+
+	records := rec.Records()
+	if len(records) != 2 || records[1].Offset != 4 {
+		t.Errorf("records %v, want the failed write left out", records)
+	}
+}
+
+func TestReplayInterrupt(t *testing.T) {
+	records := []shapeio.Record{{Offset: 0}, {Offset: 1, Elapsed: time.Hour}}
+	rr := shapeio.NewReplayReader(bytes.NewReader([]byte("ab")), records)
+	p := make([]byte, 16)
+	if n, err := rr.Read(p); n != 1 || err != nil {
+		t.Fatalf("Read = %d, %v; want 1, nil", n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, err := rr.ReadContext(ctx, p); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("ReadContext = %d, %v; want 0, %v", n, err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rr.Read(p)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rr.Close()
+	select {
+	case err := <-errc:
+		if err != shapeio.ErrClosed {
+			t.Errorf("Read = %v after Close, want %v", err, shapeio.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not interrupt Read")
+	}
+}
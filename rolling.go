@@ -0,0 +1,88 @@
+package shapeio
+
+import (
+	"io"
+	"sync"
+)
+
+// RollingWriter is a Writer that splits the written data into destinations of
+// a fixed size, opening a new one when the current one fills. The rate limit
+// applies to the whole stream across the destinations.
+type RollingWriter struct {
+	*Writer
+	sink *rollingSink
+}
+
+// NewRollingWriter returns a RollingWriter that writes to the destinations
+// returned by open, up to size bytes each. A destination is opened by the
+// first Write that needs it, and closed when it fills or on Close.
+func NewRollingWriter(open func() (io.WriteCloser, error), size int64) *RollingWriter {
+	sink := &rollingSink{open: open, size: size}
+	return &RollingWriter{
+		Writer: NewWriter(sink),
+		sink:   sink,
+	}
+}
+
+// Destinations returns the number of destinations opened so far.
+func (r *RollingWriter) Destinations() int {
+	r.sink.mu.Lock()
+	defer r.sink.mu.Unlock()
+	return r.sink.opened
+}
+
+// rollingSink writes to a destination until it fills.
+type rollingSink struct {
+	mu      sync.Mutex
+	open    func() (io.WriteCloser, error)
+	size    int64
+	cur     io.WriteCloser
+	written int64
+	opened  int
+}
+
+func (s *rollingSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for n < len(p) {
+		if s.cur == nil {
+			w, err := s.open()
+			if err != nil {
+				return n, err
+			}
+			s.cur, s.written = w, 0
+			s.opened++
+		}
+		piece := p[n:]
+		if room := s.size - s.written; s.size > 0 && int64(len(piece)) > room {
+			piece = piece[:room]
+		}
+		m, err := s.cur.Write(piece)
+		n += m
+		s.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if s.size > 0 && s.written >= s.size {
+			err := s.cur.Close()
+			s.cur = nil
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close closes the current destination.
+func (s *rollingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
@@ -0,0 +1,56 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// shard is a destination of RollingWriter.
+type shard struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *shard) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestRollingWriter(t *testing.T) {
+	limit := float64(40 * 1024) // 40KB/sec
+	var shards []*shard
+	w := shapeio.NewRollingWriter(func() (io.WriteCloser, error) {
+		s := &shard{}
+		shards = append(shards, s)
+		return s, nil
+	}, 8*1024)
+	w.SetRateLimit(limit)
+
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		if _, err := w.Write(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shards) != 2 || w.Destinations() != 2 {
+		t.Fatalf("%d destinations, want 2", len(shards))
+	}
+	if shards[0].Len() != 8*1024 || shards[1].Len() != 4*1024 {
+		t.Errorf("destinations of %d and %d bytes", shards[0].Len(), shards[1].Len())
+	}
+	if !shards[0].closed || !shards[1].closed {
+		t.Error("destination not closed")
+	}
+	if realRate := float64(12*1024) / elapsed.Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
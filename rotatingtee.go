@@ -0,0 +1,251 @@
+package shapeio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrLogDropped is reported to the function set by SetLogErrorFunc for the
+// data left out of the log of RotatingTeeWriter, as its queue was full.
+var ErrLogDropped = errors.New("shapeio: log queue full, data dropped")
+
+// defaultLogQueueSize is the bytes queued to the log by default.
+const defaultLogQueueSize = 4 << 20
+
+// RotatingTeeWriter is a Writer that also mirrors the written data into a
+// log file, which is rotated when it reaches a size. The log is written
+// asynchronously, so that it never stalls the rate-limited writes, and its
+// errors are reported to the function set by SetLogErrorFunc instead of
+// failing the writes. The data queued beyond a bound, set by
+// SetLogQueueSize, is dropped from the log. Close must be called to flush the
+// log and stop its goroutine, which leaks otherwise.
+type RotatingTeeWriter struct {
+	*Writer
+	log *rotatingLog
+}
+
+// NewRotatingTeeWriter returns a RotatingTeeWriter that writes to w and
+// mirrors into the log file at path. When the log reaches maxSize bytes, it
+// is renamed to path.1, path.2, and so on, and a new one is started; the
+// numbering resumes after the rotated files already there. Zero maxSize
+// disables the rotation.
+func NewRotatingTeeWriter(w io.Writer, path string, maxSize int64) *RotatingTeeWriter {
+	l := newRotatingLog(path, maxSize)
+	return &RotatingTeeWriter{
+		Writer: NewWriter(teeWriter{w: w, log: l}),
+		log:    l,
+	}
+}
+
+// SetLogErrorFunc sets f to be called with errors of the log.
+func (t *RotatingTeeWriter) SetLogErrorFunc(f func(error)) {
+	t.log.mu.Lock()
+	defer t.log.mu.Unlock()
+	t.log.errFunc = f
+}
+
+// SetLogQueueSize sets the bytes queued to the log at most, beyond which the
+// data is dropped from the log and ErrLogDropped is reported. Zero or less
+// restores the default of 4MB.
+func (t *RotatingTeeWriter) SetLogQueueSize(n int) {
+	if n <= 0 {
+		n = defaultLogQueueSize
+	}
+	t.log.mu.Lock()
+	defer t.log.mu.Unlock()
+	t.log.queueSize = n
+}
+
+// teeWriter writes to w and queues the written bytes to log.
+type teeWriter struct {
+	w   io.Writer
+	log *rotatingLog
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.log.append(p[:n])
+	return n, err
+}
+
+// Close flushes the log, and closes w if it is an io.Closer.
+func (t teeWriter) Close() error {
+	t.log.close()
+	if c, ok := t.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type rotatingLog struct {
+	path      string
+	maxSize   int64
+	file      *os.File
+	size      int64
+	rotations int
+	errFunc   func(error)
+	queue     [][]byte
+	queued    int // bytes in queue
+	queueSize int // bound of queued
+	closed    bool
+	mu        sync.Mutex
+	cond      *sync.Cond
+	done      chan struct{}
+}
+
+func newRotatingLog(path string, maxSize int64) *rotatingLog {
+	l := &rotatingLog{
+		path:      path,
+		maxSize:   maxSize,
+		queueSize: defaultLogQueueSize,
+		rotations: -1,
+		done:      make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	go l.run()
+	return l
+}
+
+// append queues a copy of p, or drops it if the queue is full.
+func (l *rotatingLog) append(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	if l.queued+len(p) > l.queueSize {
+		l.mu.Unlock()
+		l.report(ErrLogDropped)
+		return
+	}
+	l.queue = append(l.queue, append([]byte(nil), p...))
+	l.queued += len(p)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// close waits until the queue is written.
+func (l *rotatingLog) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *rotatingLog) run() {
+	defer close(l.done)
+	for {
+		l.mu.Lock()
+		for len(l.queue) == 0 && !l.closed {
+			l.cond.Wait()
+		}
+		if len(l.queue) == 0 {
+			l.mu.Unlock()
+			l.report(l.closeFile())
+			return
+		}
+		p := l.queue[0]
+		l.queue = l.queue[1:]
+		l.queued -= len(p)
+		l.mu.Unlock()
+		l.report(l.write(p))
+	}
+}
+
+func (l *rotatingLog) report(err error) {
+	l.mu.Lock()
+	f := l.errFunc
+	l.mu.Unlock()
+	if err != nil && f != nil {
+		f(err)
+	}
+}
+
+// write writes p, rotating the file at maxSize.
+func (l *rotatingLog) write(p []byte) error {
+	for len(p) > 0 {
+		if l.file == nil {
+			f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			st, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			l.file, l.size = f, st.Size()
+		}
+		if l.maxSize > 0 && l.size >= l.maxSize {
+			if err := l.rotate(); err != nil {
+				return err
+			}
+			continue
+		}
+		n := len(p)
+		if space := l.maxSize - l.size; l.maxSize > 0 && int64(n) > space {
+			n = int(space)
+		}
+		m, err := l.file.Write(p[:n])
+		l.size += int64(m)
+		p = p[m:]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *rotatingLog) rotate() error {
+	if err := l.closeFile(); err != nil {
+		return err
+	}
+	if l.rotations < 0 {
+		n, err := l.lastRotation()
+		if err != nil {
+			return err
+		}
+		l.rotations = n
+	}
+	l.rotations++
+	return os.Rename(l.path, fmt.Sprintf("%s.%d", l.path, l.rotations))
+}
+
+func (l *rotatingLog) closeFile() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// lastRotation returns the highest number of the rotated files, or 0 if none.
+func (l *rotatingLog) lastRotation() (int, error) {
+	infos, err := ioutil.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		return 0, err
+	}
+	prefix := filepath.Base(l.path) + "."
+	var last int
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(info.Name(), prefix)); err == nil && n > last {
+			last = n
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,153 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestRotatingTeeWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapeio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	var primary bytes.Buffer
+	w := shapeio.NewRotatingTeeWriter(&primary, path, 1000)
+	w.SetRateLimit(100 * 1024) // 100KB/sec
+	w.SetLogErrorFunc(func(err error) {
+		t.Error(err)
+	})
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for i := 0; i < len(data); i += 250 {
+		if _, err := w.Write(data[i : i+250]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(primary.Bytes(), data) {
+		t.Error("unexpected primary data")
+	}
+	var logged []byte
+	for i, c := range []struct {
+		name string
+		size int
+	}{
+		{"audit.log.1", 1000},
+		{"audit.log.2", 1000},
+		{"audit.log", 500},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != c.size {
+			t.Errorf("log %d %s has %d bytes, want %d", i, c.name, len(b), c.size)
+		}
+		logged = append(logged, b...)
+	}
+	if !bytes.Equal(logged, data) {
+		t.Error("unexpected logged data")
+	}
+}
+
+func TestRotatingTeeWriterResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapeio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	for _, name := range []string{"audit.log.1", "audit.log.2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := shapeio.NewRotatingTeeWriter(ioutil.Discard, path, 1000)
+	w.SetLogErrorFunc(func(err error) {
+		t.Error(err)
+	})
+	if _, err := w.Write(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		size int
+	}{
+		{"audit.log.1", len("audit.log.1")},
+		{"audit.log.2", len("audit.log.2")},
+		{"audit.log.3", 1000},
+		{"audit.log", 500},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != c.size {
+			t.Errorf("%s has %d bytes, want %d", c.name, len(b), c.size)
+		}
+	}
+}
+
+func TestRotatingTeeWriterDrop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shapeio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the log fails to open, and the error func stalls it meanwhile
+	path := filepath.Join(dir, "missing", "audit.log")
+
+	var primary bytes.Buffer
+	w := shapeio.NewRotatingTeeWriter(&primary, path, 0)
+	w.SetLogQueueSize(100)
+	var mu sync.Mutex
+	var dropped int
+	stall := make(chan struct{})
+	w.SetLogErrorFunc(func(err error) {
+		if err == shapeio.ErrLogDropped {
+			mu.Lock()
+			dropped++
+			mu.Unlock()
+			return
+		}
+		<-stall
+	})
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write(make([]byte, 50)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stall)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if primary.Len() != 500 {
+		t.Errorf("primary has %d bytes, want 500", primary.Len())
+	}
+	// one write is taken by the stalled log, and two are queued
+	mu.Lock()
+	defer mu.Unlock()
+	if dropped < 7 {
+		t.Errorf("%d writes dropped, want at least 7", dropped)
+	}
+}
@@ -1,8 +1,13 @@
 package shapeio
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"hash"
 	"io"
+	"log"
+	"math"
 	"sync"
 	"time"
 
@@ -11,104 +16,1556 @@ import (
 
 const burstLimit = 1000 * 1000 * 1000
 
+// MaxRate is the rate limit (bytes/sec) at or above which no rate limit is
+// applied, as effectively unlimited.
+const MaxRate = 1e12
+
+// ErrWouldBlock is returned by TryRead and TryWrite when the rate limit does
+// not allow the operation to proceed immediately.
+var ErrWouldBlock = errors.New("shapeio: operation would block")
+
+// ErrClosed is returned by operations on a closed wrapper.
+var ErrClosed = errors.New("shapeio: closed")
+
+// ErrInvalidRate is returned by SetRateLimitErr and the other rate setters for
+// a NaN or negative rate.
+var ErrInvalidRate = errors.New("shapeio: invalid rate limit")
+
+// ErrDigestMismatch is returned by a Reader at EOF instead of io.EOF if the
+// checksum of the bytes delivered does not match the one expected by
+// SetExpectedDigest.
+var ErrDigestMismatch = errors.New("shapeio: digest mismatch")
+
+// ErrNilReader is returned by reads of a Reader wrapping a nil io.Reader.
+var ErrNilReader = errors.New("shapeio: nil reader")
+
+// ErrNilWriter is returned by writes of a Writer wrapping a nil io.Writer.
+var ErrNilWriter = errors.New("shapeio: nil writer")
+
+// nilReader stands in for a nil io.Reader.
+type nilReader struct{}
+
+func (nilReader) Read(p []byte) (int, error) {
+	return 0, ErrNilReader
+}
+
+// nilWriter stands in for a nil io.Writer.
+type nilWriter struct{}
+
+func (nilWriter) Write(p []byte) (int, error) {
+	return 0, ErrNilWriter
+}
+
+// Reader is an io.Reader with rate limiting.
+// It is safe for concurrent use; reads from the underlying reader are
+// serialized. Time spent blocked in the underlying reader does not earn
+// rate limit tokens. A Reader does not implement io.WriterTo even if the
+// underlying reader does, so io.Copy cannot bypass the rate limit.
 type Reader struct {
-	r       io.Reader
-	limiter *rate.Limiter
-	ctx     context.Context
-	mu      sync.Mutex
+	r io.Reader
+	shaper
+
+	// buffer for SetMinReadSize
+	bufMu   sync.Mutex
+	minRead int
+	buf     []byte
+	bufErr  error
+
+	hashMu   sync.Mutex
+	hash     hash.Hash
+	expected []byte
+
+	minDur minDuration
 }
 
+// Writer is an io.Writer with rate limiting.
+// It is safe for concurrent use; writes to the underlying writer are
+// serialized. Time spent blocked in the underlying writer does not earn
+// rate limit tokens.
 type Writer struct {
-	w       io.Writer
-	limiter *rate.Limiter
-	ctx     context.Context
-	mu      sync.Mutex
+	w io.Writer
+	shaper
+	leaky *leakyBucket
+	wbuf  writeBuffer
+
+	transform  func(p []byte) ([]byte, error)
+	maxLatency time.Duration
 }
 
 // NewReader returns a reader that implements io.Reader with rate limiting.
-func NewReader(r io.Reader) *Reader {
-	return &Reader{
-		r:   r,
-		ctx: context.Background(),
-	}
+// If r is nil, reads return ErrNilReader.
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	return NewReaderWithContext(r, context.Background(), opts...)
 }
 
 // NewReaderWithContext returns a reader that implements io.Reader with rate limiting.
-func NewReaderWithContext(r io.Reader, ctx context.Context) *Reader {
-	return &Reader{
-		r:   r,
-		ctx: ctx,
+// If r is nil, reads return ErrNilReader.
+func NewReaderWithContext(r io.Reader, ctx context.Context, opts ...Option) *Reader {
+	if r == nil {
+		r = nilReader{}
+	}
+	s := &Reader{
+		r:      r,
+		shaper: newShaper(ctx),
+	}
+	s.global = globalLimiter()
+	for _, opt := range opts {
+		opt(&s.shaper)
 	}
+	s.register()
+	return s
 }
 
 // NewWriter returns a writer that implements io.Writer with rate limiting.
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{
-		w:   w,
-		ctx: context.Background(),
-	}
+// If w is nil, writes return ErrNilWriter.
+func NewWriter(w io.Writer, opts ...Option) *Writer {
+	return NewWriterWithContext(w, context.Background(), opts...)
 }
 
 // NewWriterWithContext returns a writer that implements io.Writer with rate limiting.
-func NewWriterWithContext(w io.Writer, ctx context.Context) *Writer {
-	return &Writer{
-		w:   w,
-		ctx: ctx,
+// If w is nil, writes return ErrNilWriter.
+func NewWriterWithContext(w io.Writer, ctx context.Context, opts ...Option) *Writer {
+	if w == nil {
+		w = nilWriter{}
+	}
+	s := &Writer{
+		w:      w,
+		shaper: newShaper(ctx),
+	}
+	s.global = globalLimiter()
+	for _, opt := range opts {
+		opt(&s.shaper)
 	}
+	s.register()
+	return s
 }
 
 // SetRateLimit sets rate limit (bytes/sec) to the reader.
+// Zero, MaxRate or more, and +Inf remove the rate limit. NaN and negative
+// values remove it too; SetRateLimitErr reports them.
 func (s *Reader) SetRateLimit(bytesPerSec float64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.setRateLimit(bytesPerSec)
+}
 
-	if s.limiter == nil {
-		s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
-		s.limiter.AllowN(time.Now(), burstLimit) // spend initial burst
-	} else {
-		s.limiter.SetLimit(rate.Limit(bytesPerSec))
-	}
+// SetRateLimitErr sets rate limit (bytes/sec) to the reader as SetRateLimit
+// does, but returns ErrInvalidRate for NaN and negative values.
+func (s *Reader) SetRateLimitErr(bytesPerSec float64) error {
+	return s.setRateLimit(bytesPerSec)
+}
+
+// SwapRateLimit sets rate limit (bytes/sec) to the reader as SetRateLimit does,
+// and returns the previous rate limit, or 0 if it was unlimited, atomically.
+// The previous value can be passed back to SwapRateLimit to restore it.
+func (s *Reader) SwapRateLimit(bytesPerSec float64) float64 {
+	return s.swapRateLimit(bytesPerSec)
+}
+
+// RateLimit returns the rate limit (bytes/sec) of the reader, the target of the
+// ramp if SetRampDuration is in effect, or 0 if unlimited.
+func (s *Reader) RateLimit() float64 {
+	return s.getRateLimit()
+}
+
+// SetThrashFunc sets f to be called when the rate limit of the reader is changed
+// more than threshold times within window, to diagnose a misbehaving
+// controller. f is called with the number of changes, at most once per window.
+// nil or a non-positive window disables the detection, which is the default.
+func (s *Reader) SetThrashFunc(threshold int, window time.Duration, f func(changes int)) {
+	s.setThrashFunc(threshold, window, f)
+}
+
+// SetBaselineRate records bytesPerSec as the baseline rate limit of the
+// reader, to be restored by RestoreBaseline after temporary changes. It does
+// not change the current rate limit.
+func (s *Reader) SetBaselineRate(bytesPerSec float64) {
+	s.setBaselineRate(bytesPerSec)
+}
+
+// RestoreBaseline sets the rate limit to the baseline recorded by
+// SetBaselineRate, as SetRateLimit does. It has no effect if no baseline is
+// recorded.
+func (s *Reader) RestoreBaseline() error {
+	return s.restoreBaseline()
+}
+
+// StepUp multiplies the rate limit of the reader by factor atomically, clamped
+// to the bounds set by SetRateBounds, and returns the new rate limit. An
+// unlimited reader steps from the maximum bound, or stays unlimited without one,
+// returning 0. A factor not positive and finite returns ErrInvalidFactor.
+func (s *Reader) StepUp(factor float64) (float64, error) {
+	return s.stepRate(factor)
+}
+
+// StepDown divides the rate limit of the reader by factor atomically, as StepUp
+// multiplies it, such that StepDown(2) halves it.
+func (s *Reader) StepDown(factor float64) (float64, error) {
+	return s.stepDown(factor)
+}
+
+// SetRateBounds sets the bounds (bytes/sec) that StepUp and StepDown clamp the
+// rate limit of the reader to. Zero means no bound. SetRateLimit is not
+// clamped. Negative values, NaN, and max less than min return ErrInvalidRate.
+func (s *Reader) SetRateBounds(min, max float64) error {
+	return s.setRateBounds(min, max)
+}
+
+// SetRateForDeadline sets the rate limit of the reader to the minimum rate at
+// which bytes are transferred by the deadline. See RateForDeadline.
+func (s *Reader) SetRateForDeadline(bytes int64, by time.Time) error {
+	return s.setRateLimit(RateForDeadline(bytes, by))
+}
+
+// SetSharedLimiter makes the reader share the bandwidth of l with the other
+// wrappers given l, in addition to its own rate limit. nil unsets it.
+func (s *Reader) SetSharedLimiter(l *Limiter) {
+	s.setSharedLimiter(l)
+}
+
+// SetBypassShared makes the reader skip the shared limiter set by
+// SetSharedLimiter, both its rate limit and SetMaxConcurrent, while its own
+// rate limit still applies, such as for emergency traffic. The group may
+// exceed its aggregate rate limit meanwhile. false restores the sharing.
+func (s *Reader) SetBypassShared(bypass bool) {
+	s.setBypassShared(bypass)
+}
+
+// SetPriority sets the priority of the reader to acquire the bandwidth of the
+// shared limiter. Higher priorities go first when contended, while waiting
+// raises the priority gradually so that lower ones still make progress. The
+// default is 0.
+func (s *Reader) SetPriority(priority int) {
+	s.setPriority(priority)
+}
+
+// SetCIR sets a two-tier rate limit (bytes/sec) to the reader: it is always
+// allowed the committed rate, and up to the peak rate while the shared
+// limiter set by SetSharedLimiter, which serves as the excess pool, has spare
+// bandwidth. The peak rate is set as by SetRateLimit. Zero committed rate
+// disables it, leaving the rate limit as is.
+func (s *Reader) SetCIR(committed, peak float64) error {
+	return s.setCIR(committed, peak)
+}
+
+// WatchControl reads newline-delimited commands from r, such as "rate 2MB",
+// and applies them to the rate limit of the reader by SetRateLimit, until EOF
+// or an error. It blocks, so run it in its own goroutine. Rates are in
+// bytes/sec with an optional unit of B, KB, MB or GB in powers of 1024, or
+// "unlimited". Malformed commands are ignored, and reported to the logger
+// set by SetLogger.
+func (s *Reader) WatchControl(r io.Reader) error {
+	return s.watchControl(r)
+}
+
+// SetBurst sets the maximum bytes that the reader transfers at once. Larger
+// reads are shortened to n bytes, so that they do not exceed the rate limit
+// momentarily. Zero removes it.
+func (s *Reader) SetBurst(n int) {
+	s.setBurst(n)
+}
+
+// SetBurstMultiplier makes the burst of the reader m seconds worth of the
+// rate limit, recomputed whenever the rate limit changes. For example, 0.1
+// makes it 100ms of bandwidth. SetBurst takes precedence over it. Zero
+// removes it.
+func (s *Reader) SetBurstMultiplier(m float64) {
+	s.setBurstMultiplier(m)
+}
+
+// Burst returns the maximum bytes that the reader transfers at once.
+func (s *Reader) Burst() int {
+	return s.getBurst()
+}
+
+// SetPacketModel makes the reader transfer in packets of up to mtu bytes,
+// each of which consumes perPacketOverhead bytes of bandwidth in addition to
+// its payload, like headers on the wire. Zero mtu disables it.
+func (s *Reader) SetPacketModel(mtu int, perPacketOverhead int) {
+	s.setPacketModel(mtu, perPacketOverhead)
+}
+
+// SetCostFunc sets f to return the bandwidth consumed by transferring p,
+// instead of len(p), to model payloads that cost more or less than their
+// length. The byte counts returned by the reader are not affected. nil
+// restores the default.
+func (s *Reader) SetCostFunc(f func(p []byte) int) {
+	s.setCostFunc(f)
+}
+
+// SetAccountant sets a to be charged with the bytes transferred by the
+// reader, for the tenant set by SetTenant. It is charged after each read, and
+// an error of the charge is returned along with the bytes read.
+func (s *Reader) SetAccountant(a Accountant) {
+	s.setAccountant(a)
+}
+
+// SetTenant sets the tenant to be charged by the accountant.
+func (s *Reader) SetTenant(tenant string) {
+	s.setTenant(tenant)
+}
+
+// SetSlowStart paces the first n bytes read from the reader at slowRate
+// (bytes/sec) at most, and removes that cap exactly at the n-th byte. The
+// rate limit of the reader applies throughout.
+func (s *Reader) SetSlowStart(n int64, slowRate float64) {
+	s.setSlowStart(n, slowRate)
+}
+
+// SetLatencyFunc sets f to be called before each chunk is read from the
+// underlying reader, to delay it by the returned duration on top of the rate
+// limit, such as to emulate the jitter of a round trip. Read blocks meanwhile
+// until the context is done; TryRead does not call f. Nil disables it.
+func (s *Reader) SetLatencyFunc(f func() time.Duration) {
+	s.setLatencyFunc(f)
+}
+
+// SetInitialDelay delays the first operation of the reader by d, to emulate
+// the latency of a connection setup. Read blocks until d has passed since the
+// first operation, or the context is done, and TryRead returns ErrWouldBlock.
+func (s *Reader) SetInitialDelay(d time.Duration) {
+	s.setInitialDelay(d)
+}
+
+// SetStartAlignment delays the first operation of the reader, after the initial
+// delay if any, until the next multiple of d in wall-clock time, so that
+// wrappers started around the same time release their first bytes together.
+// Read blocks until then, or the context is done, and TryRead returns
+// ErrWouldBlock.
+func (s *Reader) SetStartAlignment(d time.Duration) {
+	s.setStartAlignment(d)
+}
+
+// SetRatePolicy sets policy to be consulted by SetRateLimit. It is called
+// with the requested rate, +Inf for no rate limit, and returns the rate to be
+// applied actually. policy is called under the lock of the reader, so it must
+// not call methods of the reader.
+func (s *Reader) SetRatePolicy(policy func(requested float64) float64) {
+	s.setRatePolicy(policy)
+}
+
+// SetRampDuration makes subsequent SetRateLimit calls change the rate limit
+// of the reader gradually over d instead of instantly. Zero disables it.
+func (s *Reader) SetRampDuration(d time.Duration) {
+	s.setRampDuration(d)
+}
+
+// SetCatchUp enables catch-up mode, in which the reader targets the rate
+// limit on average over its lifetime: after a slow or idle period, including
+// time blocked in the underlying I/O, it exceeds the rate limit to catch up,
+// but by no more than the factor set by SetCatchUpOvershoot (2 by default).
+func (s *Reader) SetCatchUp(enabled bool) {
+	s.setCatchUp(enabled)
+}
+
+// SetCatchUpOvershoot sets the factor of the rate limit that the reader may
+// reach while catching up.
+func (s *Reader) SetCatchUpOvershoot(factor float64) {
+	s.setCatchUpOvershoot(factor)
+}
+
+// ShapedRate returns the throughput (bytes/sec) of the reader since the first
+// operation, excluding the time spent in the underlying I/O. Unlike
+// CurrentRate, it stays near the rate limit while the shaping is in effect,
+// however slow the underlying reader is.
+func (s *Reader) ShapedRate() float64 {
+	return s.shapedRate()
+}
+
+// CurrentRate returns the throughput (bytes/sec) observed over the latest
+// sampling window.
+func (s *Reader) CurrentRate() float64 {
+	return s.currentRate()
+}
+
+// SetRateSmoothing sets the factor of the exponentially weighted moving
+// average applied to the samples of CurrentRate of the reader, in (0, 1]. A
+// smaller alpha gives a steadier rate that follows changes more slowly. The
+// default 1 disables smoothing.
+func (s *Reader) SetRateSmoothing(alpha float64) error {
+	return s.setRateSmoothing(alpha)
+}
+
+// PeakRate returns the highest throughput (bytes/sec) observed over any
+// sampling window since the reader was created or last Reset.
+func (s *Reader) PeakRate() float64 {
+	return s.peakRate()
+}
+
+// SetSaturationFunc sets f to be called once when the throughput of the
+// reader first reaches its rate limit. It is called again only after Reset.
+func (s *Reader) SetSaturationFunc(f func()) {
+	s.setSaturationFunc(f)
+}
+
+// SetProgressFunc sets f to be called after each transfer of the reader with the
+// total bytes transferred so far. ctx is the context the reader was created with,
+// so f can access its values.
+func (s *Reader) SetProgressFunc(f func(ctx context.Context, total int64)) {
+	s.setProgressFunc(f)
+}
+
+// Waits returns the number of times the reader has waited for its rate limit.
+func (s *Reader) Waits() int64 {
+	return s.waitCount()
+}
+
+// FirstByteLatency returns the time from the first Read call on the reader to the
+// first byte transferred, including the initial delay and the waits for the
+// rate limit, or 0 until a byte is transferred. Reset clears it.
+func (s *Reader) FirstByteLatency() time.Duration {
+	return s.firstByteLatency()
+}
+
+// Summary returns the lifetime statistics of the reader.
+func (s *Reader) Summary() Summary {
+	return s.summary()
+}
+
+// SetLabel sets the label of the reader in the statistics of Snapshot.
+func (s *Reader) SetLabel(label string) {
+	s.setLabel(label)
+}
+
+// SetSummaryFunc sets f to be called with the Summary of the reader once, when it
+// is closed.
+func (s *Reader) SetSummaryFunc(f func(Summary)) {
+	s.setSummaryFunc(f)
+}
+
+// String returns a summary of the configuration and statistics of the reader:
+// the rate limit, the burst, the chunk size, the context, the total bytes and
+// the current rate.
+func (s *Reader) String() string {
+	return s.describe("Reader")
+}
+
+// Reset clears the throughput statistics of the reader.
+func (s *Reader) Reset() {
+	s.reset()
+}
+
+// SetFailureRate makes each Read and Write of the reader fail with err instead
+// of transferring, with probability p (0 to 1).
+func (s *Reader) SetFailureRate(p float64, err error) {
+	s.setFailureRate(p, err)
+}
+
+// SetFailureSeed seeds the random source used by SetFailureRate.
+func (s *Reader) SetFailureSeed(seed int64) {
+	s.setFailureSeed(seed)
+}
+
+// SpendTokens waits for and consumes n bytes of the reader's bandwidth
+// without transferring data, to account for out-of-band traffic.
+func (s *Reader) SpendTokens(n int64) error {
+	return s.spend(n)
+}
+
+// OffBandBytes returns the total bytes consumed by SpendTokens.
+func (s *Reader) OffBandBytes() int64 {
+	return s.offBandBytes()
+}
+
+// SetQuotaStore limits the bytes transferred per day to dailyLimit,
+// resuming from and periodically saving to store, and on Close. Once the limit
+// is consumed, the reader returns ErrQuotaExceeded.
+func (s *Reader) SetQuotaStore(store QuotaStore, dailyLimit int64) {
+	s.setQuotaStore(store, dailyLimit)
+}
+
+// SetLogger sets logger to log each throttling decision of the reader: the
+// requested bytes, the tokens available and the delay. nil disables it, which
+// is the default.
+func (s *Reader) SetLogger(logger *log.Logger) {
+	s.setLogger(logger)
+}
+
+// SetKeepalive sets fn to be called every interval while the reader waits
+// for the rate limit, for example to keep a connection warm during a long
+// wait. An error of fn aborts the read with the error. nil fn disables it.
+func (s *Reader) SetKeepalive(interval time.Duration, fn func() error) {
+	s.setKeepalive(interval, fn)
+}
+
+// SetRateController overrides the built-in token bucket of the reader, which it
+// waits for by default, with c, and forwards the rate limits set by
+// SetRateLimit to c. Features
+// that work on the token bucket, such as SetBurst, SetCatchUp,
+// SetRampDuration, SnapshotState and Reserve, keep working on the built-in one
+// and do not affect c. nil restores the built-in one.
+func (s *Reader) SetRateController(c RateController) {
+	s.setController(c)
+}
+
+// SetWaitStrategy sets the strategy to wait for the delays imposed by the
+// rate limit. nil restores the default, which reuses a single timer.
+func (s *Reader) SetWaitStrategy(ws WaitStrategy) {
+	s.setWaitStrategy(ws)
+}
+
+// SetSleepFunc makes the waits for the rate limit sleep by f, such as a high
+// resolution sleep of the platform, in slices of up to 10ms to check the
+// context between them. It replaces the wait strategy. nil restores the
+// default.
+func (s *Reader) SetSleepFunc(f func(d time.Duration)) {
+	s.setSleepFunc(f)
+}
+
+// SnapshotState returns the limiter state of the reader, to be restored by
+// RestoreState later, possibly in another process.
+func (s *Reader) SnapshotState() State {
+	return s.snapshotState()
+}
+
+// RestoreState restores the limiter state taken by SnapshotState. Time
+// elapsed since the snapshot pays off debt, but never earns more tokens than
+// the snapshot had. Restoring into a reader with a different rate limit is
+// best-effort. It has no effect if no rate limit is set.
+func (s *Reader) RestoreState(st State) {
+	s.restoreState(st)
+}
+
+// Tokens returns the bytes the reader may transfer immediately without
+// waiting, or +Inf if no rate limit is set.
+func (s *Reader) Tokens() float64 {
+	return s.tokens()
+}
+
+// Limiter returns the underlying rate limiter of the reader, or nil if no rate
+// limit is set. It is safe for concurrent use, so reservations may be made
+// on it directly. Changes made to its limit or burst may be overwritten by
+// later calls to SetRateLimit, and the limiter is replaced when the rate
+// limit is removed and set again.
+func (s *Reader) Limiter() *rate.Limiter {
+	return s.getLimiter()
+}
+
+// Reserve reserves n bytes of the reader's bandwidth without reading.
+// It returns how long the caller should wait before the reserved bytes
+// may be transferred, and a CancelFunc that returns the tokens to the limiter.
+// If no rate limit is set, the delay is zero.
+func (s *Reader) Reserve(n int64) (time.Duration, CancelFunc) {
+	return s.reserve(n)
+}
+
+// WouldBlock returns how long a Read of n bytes would wait for the rate limits
+// of the reader, its own and the shared one, given the tokens available now. It
+// does not consume tokens.
+func (s *Reader) WouldBlock(n int) time.Duration {
+	return s.wouldBlock(n)
 }
 
 // Read reads bytes into p.
 func (s *Reader) Read(p []byte) (int, error) {
-	if s.limiter == nil {
-		return s.r.Read(p)
+	return s.ReadContext(s.ctx, p)
+}
+
+// ReadContext reads bytes into p, waiting for the rate limit with ctx.
+// A rate limit attached to ctx by WithRateLimit overrides the reader's own
+// rate limit for this call.
+func (s *Reader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	if err := s.waitStart(ctx); err != nil {
+		return 0, err
 	}
-	n, err := s.r.Read(p)
+	slow := s.slowStartRemaining()
+	if slow > 0 && int64(len(p)) > slow {
+		// stop at the end of slow start
+		p = p[:slow]
+	}
+	stretch := s.startMinDuration()
+	n, err := s.readContext(ctx, p)
+	if slow > 0 {
+		if werr := s.waitSlowStart(ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if stretch != nil && err == nil {
+		err = s.waitLimiter(ctx, stretch, n)
+	}
+	if err == io.EOF {
+		if herr := s.holdEOF(ctx); herr != nil {
+			err = herr
+		}
+	}
+	s.hashBytes(p[:n])
+	return n, s.checkDigest(err)
+}
+
+func (s *Reader) readContext(ctx context.Context, p []byte) (int, error) {
+	release, err := s.admitTransfer(ctx)
 	if err != nil {
-		return n, err
+		return 0, err
 	}
-	if err := s.limiter.WaitN(s.ctx, n); err != nil {
-		return n, err
+	defer release()
+	if err := s.waitLatency(ctx); err != nil {
+		return 0, err
+	}
+	if s.minRead > 0 || len(s.buf) > 0 {
+		return s.readBuffered(ctx, p)
 	}
-	return n, nil
+	if size := s.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := s.read(p)
+	// bytes transferred along with an error are charged too
+	if werr := s.wait(ctx, s.cost(p[:n])); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// SetMinReadSize makes each wait for the rate limit cover at least n bytes
+// read from the underlying reader (or until an error such as io.EOF), so
+// that small Reads are served from an internal buffer without waiting.
+// Zero disables it.
+func (s *Reader) SetMinReadSize(n int) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	s.minRead = n
+}
+
+// readBuffered serves p from the buffer, refilling it with at least
+// minRead bytes per wait when empty.
+func (s *Reader) readBuffered(ctx context.Context, p []byte) (int, error) {
+	if len(s.buf) == 0 && s.bufErr == nil {
+		size := s.minRead
+		if size < len(p) {
+			size = len(p)
+		}
+		if cap(s.buf) < size {
+			s.buf = make([]byte, size)
+		}
+		buf := s.buf[:size]
+		filled := 0
+		for empty := 0; filled < s.minRead && s.bufErr == nil; {
+			n, err := s.read(buf[filled:])
+			filled += n
+			s.bufErr = err
+			if n == 0 && err == nil {
+				if empty++; empty >= 100 {
+					s.bufErr = io.ErrNoProgress
+				}
+			}
+		}
+		s.buf = buf[:filled]
+		if err := s.wait(ctx, s.cost(s.buf)); err != nil && s.bufErr == nil {
+			s.bufErr = err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) > 0 {
+		return n, nil
+	}
+	err := s.bufErr
+	s.bufErr = nil
+	return n, err
+}
+
+// read reads from the underlying reader without waiting for the rate limit.
+func (s *Reader) read(p []byte) (int, error) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	m := s.quotaAllowance(len(p))
+	if m == 0 && len(p) > 0 {
+		return 0, ErrQuotaExceeded
+	}
+	limiter, tokens := s.pauseTokens()
+	start := time.Now()
+	n, err := s.r.Read(p[:m])
+	s.resumeTokens(limiter, tokens)
+	s.recordIO(start, n)
+	s.record(n)
+	if aerr := s.account(n); aerr != nil && err == nil {
+		err = aerr
+	}
+	return n, err
+}
+
+// TryRead reads bytes into p only if the rate limits, the reader's own, the
+// committed, shared and global ones, allow len(p) bytes immediately.
+// Otherwise it returns ErrWouldBlock without reading.
+// A partially available budget rejects the whole read. Bytes already
+// buffered by SetMinReadSize are paid for, and are served first without
+// checking the rate limit; TryRead waits for a Read in progress meanwhile.
+func (s *Reader) TryRead(p []byte) (int, error) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	if len(s.buf) > 0 {
+		n := copy(p, s.buf)
+		s.buf = s.buf[n:]
+		var err error
+		if len(s.buf) == 0 {
+			err, s.bufErr = s.bufErr, nil
+		}
+		s.hashBytes(p[:n])
+		return n, s.checkDigest(err)
+	}
+	if s.startDelay() > 0 {
+		return 0, ErrWouldBlock
+	}
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	if s.quotaAllowance(len(p)) < len(p) {
+		return 0, ErrQuotaExceeded
+	}
+	if !s.available(len(p)) || !s.poolsAvailable(len(p)) {
+		return 0, ErrWouldBlock
+	}
+	c := s.getController()
+	if c != nil && !c.AllowN(s.now(), len(p)) {
+		// the controller cannot be charged after the fact, so it is asked
+		// for all of p
+		return 0, ErrWouldBlock
+	}
+	n, err := s.r.Read(p)
+	cost := s.cost(p[:n])
+	if c == nil {
+		s.charge(cost)
+	}
+	s.chargePools(cost)
+	s.record(n)
+	if aerr := s.account(n); aerr != nil && err == nil {
+		err = aerr
+	}
+	s.hashBytes(p[:n])
+	return n, s.checkDigest(err)
+}
+
+// SetHash sets h to be fed with the bytes delivered by the reader, in order.
+func (s *Reader) SetHash(h hash.Hash) {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	s.hash = h
+	s.expected = nil
+}
+
+// SetExpectedDigest sets h to be fed with the bytes delivered by the reader as
+// SetHash does, and makes the reader return ErrDigestMismatch instead of
+// io.EOF if the checksum at EOF does not equal expected.
+func (s *Reader) SetExpectedDigest(h hash.Hash, expected []byte) {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	s.hash = h
+	s.expected = append([]byte(nil), expected...)
+}
+
+// Sum appends the checksum of the bytes delivered so far to b and returns
+// the resulting slice. It returns b if no hash is set by SetHash.
+func (s *Reader) Sum(b []byte) []byte {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	if s.hash == nil {
+		return b
+	}
+	return s.hash.Sum(b)
+}
+
+// checkDigest returns ErrDigestMismatch for io.EOF if the checksum does not
+// equal the expected one.
+func (s *Reader) checkDigest(err error) error {
+	if err != io.EOF {
+		return err
+	}
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	if s.hash != nil && s.expected != nil && !bytes.Equal(s.hash.Sum(nil), s.expected) {
+		return ErrDigestMismatch
+	}
+	return err
+}
+
+func (s *Reader) hashBytes(p []byte) {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	if s.hash != nil && len(p) > 0 {
+		s.hash.Write(p)
+	}
+}
+
+// Close makes pending and further Reads return ErrClosed, closes the
+// underlying reader if it implements io.Closer, saves the bytes consumed to
+// the store of SetQuotaStore, and calls the function set by SetSummaryFunc.
+func (s *Reader) Close() error {
+	s.close()
+	var err error
+	if c, ok := s.r.(io.Closer); ok {
+		err = c.Close()
+	}
+	s.saveQuota()
+	s.summarize()
+	return err
 }
 
 // SetRateLimit sets rate limit (bytes/sec) to the writer.
+// Zero, MaxRate or more, and +Inf remove the rate limit. NaN and negative
+// values remove it too; SetRateLimitErr reports them.
 func (s *Writer) SetRateLimit(bytesPerSec float64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.setRateLimit(bytesPerSec)
+}
 
-	if s.limiter == nil {
-		s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
-		s.limiter.AllowN(time.Now(), burstLimit) // spend initial burst
-	} else {
-		s.limiter.SetLimit(rate.Limit(bytesPerSec))
-	}
+// SetRateLimitErr sets rate limit (bytes/sec) to the writer as SetRateLimit
+// does, but returns ErrInvalidRate for NaN and negative values.
+func (s *Writer) SetRateLimitErr(bytesPerSec float64) error {
+	return s.setRateLimit(bytesPerSec)
+}
+
+// SwapRateLimit sets rate limit (bytes/sec) to the writer as SetRateLimit does,
+// and returns the previous rate limit, or 0 if it was unlimited, atomically.
+// The previous value can be passed back to SwapRateLimit to restore it.
+func (s *Writer) SwapRateLimit(bytesPerSec float64) float64 {
+	return s.swapRateLimit(bytesPerSec)
+}
+
+// RateLimit returns the rate limit (bytes/sec) of the writer, the target of the
+// ramp if SetRampDuration is in effect, or 0 if unlimited.
+func (s *Writer) RateLimit() float64 {
+	return s.getRateLimit()
+}
+
+// SetThrashFunc sets f to be called when the rate limit of the writer is changed
+// more than threshold times within window, to diagnose a misbehaving
+// controller. f is called with the number of changes, at most once per window.
+// nil or a non-positive window disables the detection, which is the default.
+func (s *Writer) SetThrashFunc(threshold int, window time.Duration, f func(changes int)) {
+	s.setThrashFunc(threshold, window, f)
+}
+
+// SetBaselineRate records bytesPerSec as the baseline rate limit of the
+// writer, to be restored by RestoreBaseline after temporary changes. It does
+// not change the current rate limit.
+func (s *Writer) SetBaselineRate(bytesPerSec float64) {
+	s.setBaselineRate(bytesPerSec)
+}
+
+// RestoreBaseline sets the rate limit to the baseline recorded by
+// SetBaselineRate, as SetRateLimit does. It has no effect if no baseline is
+// recorded.
+func (s *Writer) RestoreBaseline() error {
+	return s.restoreBaseline()
+}
+
+// StepUp multiplies the rate limit of the writer by factor atomically, clamped
+// to the bounds set by SetRateBounds, and returns the new rate limit. An
+// unlimited writer steps from the maximum bound, or stays unlimited without one,
+// returning 0. A factor not positive and finite returns ErrInvalidFactor.
+func (s *Writer) StepUp(factor float64) (float64, error) {
+	return s.stepRate(factor)
+}
+
+// StepDown divides the rate limit of the writer by factor atomically, as StepUp
+// multiplies it, such that StepDown(2) halves it.
+func (s *Writer) StepDown(factor float64) (float64, error) {
+	return s.stepDown(factor)
+}
+
+// SetRateBounds sets the bounds (bytes/sec) that StepUp and StepDown clamp the
+// rate limit of the writer to. Zero means no bound. SetRateLimit is not
+// clamped. Negative values, NaN, and max less than min return ErrInvalidRate.
+func (s *Writer) SetRateBounds(min, max float64) error {
+	return s.setRateBounds(min, max)
+}
+
+// SetRateForDeadline sets the rate limit of the writer to the minimum rate at
+// which bytes are transferred by the deadline. See RateForDeadline.
+func (s *Writer) SetRateForDeadline(bytes int64, by time.Time) error {
+	return s.setRateLimit(RateForDeadline(bytes, by))
+}
+
+// SetSharedLimiter makes the writer share the bandwidth of l with the other
+// wrappers given l, in addition to its own rate limit. nil unsets it.
+func (s *Writer) SetSharedLimiter(l *Limiter) {
+	s.setSharedLimiter(l)
+}
+
+// SetBypassShared makes the writer skip the shared limiter set by
+// SetSharedLimiter, both its rate limit and SetMaxConcurrent, while its own
+// rate limit still applies, such as for emergency traffic. The group may
+// exceed its aggregate rate limit meanwhile. false restores the sharing.
+func (s *Writer) SetBypassShared(bypass bool) {
+	s.setBypassShared(bypass)
+}
+
+// SetPriority sets the priority of the writer to acquire the bandwidth of the
+// shared limiter. Higher priorities go first when contended, while waiting
+// raises the priority gradually so that lower ones still make progress. The
+// default is 0.
+func (s *Writer) SetPriority(priority int) {
+	s.setPriority(priority)
+}
+
+// SetCIR sets a two-tier rate limit (bytes/sec) to the writer: it is always
+// allowed the committed rate, and up to the peak rate while the shared
+// limiter set by SetSharedLimiter, which serves as the excess pool, has spare
+// bandwidth. The peak rate is set as by SetRateLimit. Zero committed rate
+// disables it, leaving the rate limit as is.
+func (s *Writer) SetCIR(committed, peak float64) error {
+	return s.setCIR(committed, peak)
+}
+
+// WatchControl reads newline-delimited commands from r, such as "rate 2MB",
+// and applies them to the rate limit of the writer by SetRateLimit, until EOF
+// or an error. It blocks, so run it in its own goroutine. Rates are in
+// bytes/sec with an optional unit of B, KB, MB or GB in powers of 1024, or
+// "unlimited". Malformed commands are ignored, and reported to the logger
+// set by SetLogger.
+func (s *Writer) WatchControl(r io.Reader) error {
+	return s.watchControl(r)
+}
+
+// SetBurst sets the maximum bytes that the writer transfers at once. Larger
+// writes are split into throttled pieces of n bytes, so that they do not exceed
+// the rate limit momentarily. Zero removes it.
+func (s *Writer) SetBurst(n int) {
+	s.setBurst(n)
+}
+
+// SetBurstMultiplier makes the burst of the writer m seconds worth of the
+// rate limit, recomputed whenever the rate limit changes. For example, 0.1
+// makes it 100ms of bandwidth. SetBurst takes precedence over it. Zero
+// removes it.
+func (s *Writer) SetBurstMultiplier(m float64) {
+	s.setBurstMultiplier(m)
+}
+
+// Burst returns the maximum bytes that the writer transfers at once.
+func (s *Writer) Burst() int {
+	return s.getBurst()
+}
+
+// SetPacketModel makes the writer transfer in packets of up to mtu bytes,
+// each of which consumes perPacketOverhead bytes of bandwidth in addition to
+// its payload, like headers on the wire. Zero mtu disables it.
+func (s *Writer) SetPacketModel(mtu int, perPacketOverhead int) {
+	s.setPacketModel(mtu, perPacketOverhead)
+}
+
+// SetCostFunc sets f to return the bandwidth consumed by transferring p,
+// instead of len(p), to model payloads that cost more or less than their
+// length. The byte counts returned by the writer are not affected. nil
+// restores the default.
+func (s *Writer) SetCostFunc(f func(p []byte) int) {
+	s.setCostFunc(f)
+}
+
+// SetAccountant sets a to be charged with the bytes transferred by the
+// writer, for the tenant set by SetTenant. It is charged before each write,
+// and an error of the charge fails the write.
+func (s *Writer) SetAccountant(a Accountant) {
+	s.setAccountant(a)
+}
+
+// SetTenant sets the tenant to be charged by the accountant.
+func (s *Writer) SetTenant(tenant string) {
+	s.setTenant(tenant)
+}
+
+// SetLatencyFunc sets f to be called before each chunk is written to the
+// underlying writer, to delay it by the returned duration on top of the rate
+// limit, such as to emulate the jitter of a round trip. Write blocks meanwhile
+// until the context is done; TryWrite does not call f. Nil disables it.
+func (s *Writer) SetLatencyFunc(f func() time.Duration) {
+	s.setLatencyFunc(f)
+}
+
+// SetInitialDelay delays the first operation of the writer by d, to emulate
+// the latency of a connection setup. Write blocks until d has passed since the
+// first operation, or the context is done, and TryWrite returns ErrWouldBlock.
+func (s *Writer) SetInitialDelay(d time.Duration) {
+	s.setInitialDelay(d)
+}
+
+// SetStartAlignment delays the first operation of the writer, after the initial
+// delay if any, until the next multiple of d in wall-clock time, so that
+// wrappers started around the same time release their first bytes together.
+// Write blocks until then, or the context is done, and TryWrite returns
+// ErrWouldBlock.
+func (s *Writer) SetStartAlignment(d time.Duration) {
+	s.setStartAlignment(d)
+}
+
+// SetRatePolicy sets policy to be consulted by SetRateLimit. It is called
+// with the requested rate, +Inf for no rate limit, and returns the rate to be
+// applied actually. policy is called under the lock of the writer, so it must
+// not call methods of the writer.
+func (s *Writer) SetRatePolicy(policy func(requested float64) float64) {
+	s.setRatePolicy(policy)
+}
+
+// SetRampDuration makes subsequent SetRateLimit calls change the rate limit
+// of the writer gradually over d instead of instantly. Zero disables it.
+func (s *Writer) SetRampDuration(d time.Duration) {
+	s.setRampDuration(d)
+}
+
+// SetCatchUp enables catch-up mode, in which the writer targets the rate
+// limit on average over its lifetime: after a slow or idle period, including
+// time blocked in the underlying I/O, it exceeds the rate limit to catch up,
+// but by no more than the factor set by SetCatchUpOvershoot (2 by default).
+func (s *Writer) SetCatchUp(enabled bool) {
+	s.setCatchUp(enabled)
+}
+
+// SetCatchUpOvershoot sets the factor of the rate limit that the writer may
+// reach while catching up.
+func (s *Writer) SetCatchUpOvershoot(factor float64) {
+	s.setCatchUpOvershoot(factor)
+}
+
+// ShapedRate returns the throughput (bytes/sec) of the writer since the first
+// operation, excluding the time spent in the underlying I/O. Unlike
+// CurrentRate, it stays near the rate limit while the shaping is in effect,
+// however slow the underlying writer is.
+func (s *Writer) ShapedRate() float64 {
+	return s.shapedRate()
+}
+
+// CurrentRate returns the throughput (bytes/sec) observed over the latest
+// sampling window.
+func (s *Writer) CurrentRate() float64 {
+	return s.currentRate()
+}
+
+// SetRateSmoothing sets the factor of the exponentially weighted moving
+// average applied to the samples of CurrentRate of the writer, in (0, 1]. A
+// smaller alpha gives a steadier rate that follows changes more slowly. The
+// default 1 disables smoothing.
+func (s *Writer) SetRateSmoothing(alpha float64) error {
+	return s.setRateSmoothing(alpha)
+}
+
+// PeakRate returns the highest throughput (bytes/sec) observed over any
+// sampling window since the writer was created or last Reset.
+func (s *Writer) PeakRate() float64 {
+	return s.peakRate()
+}
+
+// SetSaturationFunc sets f to be called once when the throughput of the
+// writer first reaches its rate limit. It is called again only after Reset.
+func (s *Writer) SetSaturationFunc(f func()) {
+	s.setSaturationFunc(f)
+}
+
+// SetProgressFunc sets f to be called after each transfer of the writer with the
+// total bytes transferred so far. ctx is the context the writer was created with,
+// so f can access its values.
+func (s *Writer) SetProgressFunc(f func(ctx context.Context, total int64)) {
+	s.setProgressFunc(f)
+}
+
+// Waits returns the number of times the writer has waited for its rate limit.
+func (s *Writer) Waits() int64 {
+	return s.waitCount()
+}
+
+// FirstByteLatency returns the time from the first Write call on the writer to the
+// first byte transferred, including the initial delay and the waits for the
+// rate limit, or 0 until a byte is transferred. Reset clears it.
+func (s *Writer) FirstByteLatency() time.Duration {
+	return s.firstByteLatency()
+}
+
+// Summary returns the lifetime statistics of the writer.
+func (s *Writer) Summary() Summary {
+	return s.summary()
+}
+
+// SetLabel sets the label of the writer in the statistics of Snapshot.
+func (s *Writer) SetLabel(label string) {
+	s.setLabel(label)
+}
+
+// SetSummaryFunc sets f to be called with the Summary of the writer once, when it
+// is closed.
+func (s *Writer) SetSummaryFunc(f func(Summary)) {
+	s.setSummaryFunc(f)
+}
+
+// String returns a summary of the configuration and statistics of the writer:
+// the rate limit, the burst, the chunk size, the context, the total bytes and
+// the current rate.
+func (s *Writer) String() string {
+	return s.describe("Writer")
+}
+
+// Reset clears the throughput statistics of the writer.
+func (s *Writer) Reset() {
+	s.reset()
+}
+
+// SetFailureRate makes each Read and Write of the writer fail with err instead
+// of transferring, with probability p (0 to 1).
+func (s *Writer) SetFailureRate(p float64, err error) {
+	s.setFailureRate(p, err)
+}
+
+// SetFailureSeed seeds the random source used by SetFailureRate.
+func (s *Writer) SetFailureSeed(seed int64) {
+	s.setFailureSeed(seed)
+}
+
+// SpendTokens waits for and consumes n bytes of the writer's bandwidth
+// without transferring data, to account for out-of-band traffic.
+func (s *Writer) SpendTokens(n int64) error {
+	return s.spend(n)
+}
+
+// OffBandBytes returns the total bytes consumed by SpendTokens.
+func (s *Writer) OffBandBytes() int64 {
+	return s.offBandBytes()
+}
+
+// SetQuotaStore limits the bytes transferred per day to dailyLimit,
+// resuming from and periodically saving to store, and on Close. Once the limit
+// is consumed, the writer returns ErrQuotaExceeded.
+func (s *Writer) SetQuotaStore(store QuotaStore, dailyLimit int64) {
+	s.setQuotaStore(store, dailyLimit)
+}
+
+// SetLogger sets logger to log each throttling decision of the writer: the
+// requested bytes, the tokens available and the delay. nil disables it, which
+// is the default.
+func (s *Writer) SetLogger(logger *log.Logger) {
+	s.setLogger(logger)
+}
+
+// SetRateController overrides the built-in token bucket of the writer, which it
+// waits for by default, with c, and forwards the rate limits set by
+// SetRateLimit to c. Features
+// that work on the token bucket, such as SetBurst, SetCatchUp,
+// SetRampDuration, SnapshotState and Reserve, keep working on the built-in one
+// and do not affect c. nil restores the built-in one.
+func (s *Writer) SetRateController(c RateController) {
+	s.setController(c)
+}
+
+// SetWaitStrategy sets the strategy to wait for the delays imposed by the
+// rate limit. nil restores the default, which reuses a single timer.
+func (s *Writer) SetWaitStrategy(ws WaitStrategy) {
+	s.setWaitStrategy(ws)
+}
+
+// SetSleepFunc makes the waits for the rate limit sleep by f, such as a high
+// resolution sleep of the platform, in slices of up to 10ms to check the
+// context between them. It replaces the wait strategy. nil restores the
+// default.
+func (s *Writer) SetSleepFunc(f func(d time.Duration)) {
+	s.setSleepFunc(f)
+}
+
+// SnapshotState returns the limiter state of the writer, to be restored by
+// RestoreState later, possibly in another process.
+func (s *Writer) SnapshotState() State {
+	return s.snapshotState()
+}
+
+// RestoreState restores the limiter state taken by SnapshotState. Time
+// elapsed since the snapshot pays off debt, but never earns more tokens than
+// the snapshot had. Restoring into a writer with a different rate limit is
+// best-effort. It has no effect if no rate limit is set.
+func (s *Writer) RestoreState(st State) {
+	s.restoreState(st)
+}
+
+// Tokens returns the bytes the writer may transfer immediately without
+// waiting, or +Inf if no rate limit is set.
+func (s *Writer) Tokens() float64 {
+	return s.tokens()
+}
+
+// Limiter returns the underlying rate limiter of the writer, or nil if no rate
+// limit is set. It is safe for concurrent use, so reservations may be made
+// on it directly. Changes made to its limit or burst may be overwritten by
+// later calls to SetRateLimit, and the limiter is replaced when the rate
+// limit is removed and set again.
+func (s *Writer) Limiter() *rate.Limiter {
+	return s.getLimiter()
+}
+
+// Reserve reserves n bytes of the writer's bandwidth without writing.
+// It returns how long the caller should wait before the reserved bytes
+// may be transferred, and a CancelFunc that returns the tokens to the limiter.
+// If no rate limit is set, the delay is zero.
+func (s *Writer) Reserve(n int64) (time.Duration, CancelFunc) {
+	return s.reserve(n)
+}
+
+// WouldBlock returns how long a Write of n bytes would wait for the rate limits
+// of the writer, its own and the shared one, given the tokens available now. It
+// does not consume tokens.
+func (s *Writer) WouldBlock(n int) time.Duration {
+	return s.wouldBlock(n)
 }
 
 // Write writes bytes from p.
 func (s *Writer) Write(p []byte) (int, error) {
-	if s.limiter == nil {
-		return s.w.Write(p)
+	return s.WriteContext(s.ctx, p)
+}
+
+// WriteContext writes bytes from p, waiting for the rate limit with ctx.
+// A rate limit attached to ctx by WithRateLimit overrides the writer's own
+// rate limit for this call.
+func (s *Writer) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if err := s.waitStart(ctx); err != nil {
+		return 0, err
 	}
-	n, err := s.w.Write(p)
-	if err != nil {
-		return n, err
+	if b := s.leakyBucket(); b != nil {
+		f := s.postTransform()
+		if f == nil {
+			return b.write(ctx, p)
+		}
+		q, err := f(p)
+		if err != nil {
+			return 0, err
+		}
+		n, err := b.write(ctx, q)
+		return transformed(p, q, n, err)
+	}
+	if m := s.latencyAllowance(ctx); m > 0 && len(p) > m {
+		// the caller writes the rest
+		p = p[:m]
 	}
-	if err := s.limiter.WaitN(s.ctx, n); err != nil {
+	if n, ok, err := s.writeBuffered(ctx, p); ok {
 		return n, err
 	}
+	return s.writeChunks(ctx, p)
+}
+
+// writeChunks writes p in chunks, waiting for the rate limit with ctx.
+func (s *Writer) writeChunks(ctx context.Context, p []byte) (int, error) {
+	size := s.chunkSize()
+	if len(p) <= size {
+		return s.writeContext(ctx, p)
+	}
+	// write in pieces not to exceed the rate limit at once
+	var written int
+	for written < len(p) {
+		piece := p[written:]
+		if len(piece) > size {
+			piece = piece[:size]
+		}
+		n, err := s.writeContext(ctx, piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < len(piece) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (s *Writer) writeContext(ctx context.Context, p []byte) (int, error) {
+	release, err := s.admitTransfer(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if err := s.waitLatency(ctx); err != nil {
+		return 0, err
+	}
+	f := s.postTransform()
+	q := p
+	if f != nil {
+		if q, err = f(p); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.write(q)
+	// bytes transferred along with an error are charged too
+	if werr := s.wait(ctx, s.cost(q[:n])); werr != nil && err == nil {
+		err = werr
+	}
+	if f != nil {
+		return transformed(p, q, n, err)
+	}
+	return n, err
+}
+
+// write writes to the underlying writer without waiting for the rate limit.
+func (s *Writer) write(p []byte) (int, error) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	m := s.quotaAllowance(len(p))
+	if m == 0 && len(p) > 0 {
+		return 0, ErrQuotaExceeded
+	}
+	if err := s.account(m); err != nil {
+		return 0, err
+	}
+	limiter, tokens := s.pauseTokens()
+	start := time.Now()
+	n, err := s.w.Write(p[:m])
+	s.resumeTokens(limiter, tokens)
+	s.recordIO(start, n)
+	s.record(n)
+	if err == nil && m < len(p) {
+		err = ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// TryWrite writes bytes from p only if the rate limits, the writer's own, the
+// committed, shared and global ones, allow len(p) bytes immediately.
+// Otherwise it returns ErrWouldBlock without writing.
+// A partially available budget rejects the whole write.
+func (s *Writer) TryWrite(p []byte) (int, error) {
+	if b := s.leakyBucket(); b != nil {
+		return b.tryWrite(p)
+	}
+	if s.startDelay() > 0 {
+		return 0, ErrWouldBlock
+	}
+	f := s.postTransform()
+	q := p
+	if f != nil {
+		var err error
+		if q, err = f(p); err != nil {
+			return 0, err
+		}
+	}
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	if s.quotaAllowance(len(q)) < len(q) {
+		return 0, ErrQuotaExceeded
+	}
+	if !s.allow(s.cost(q)) {
+		return 0, ErrWouldBlock
+	}
+	if err := s.account(len(q)); err != nil {
+		return 0, err
+	}
+	n, err := s.w.Write(q)
+	s.record(n)
+	if f != nil {
+		return transformed(p, q, n, err)
+	}
 	return n, err
 }
+
+// WriteAtRate writes p to dst with rate limit (bytes/sec), and returns the
+// achieved rate (bytes/sec) and the time it took. The rate is 0 if nothing is
+// written or the time is too short to measure, such as for an empty p.
+func WriteAtRate(dst io.Writer, p []byte, bytesPerSec float64) (float64, time.Duration, error) {
+	w := NewWriter(dst)
+	defer w.deregister()
+	if err := w.SetRateLimitErr(bytesPerSec); err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	n, err := w.Write(p)
+	elapsed := time.Since(start)
+	if n == 0 || elapsed <= 0 {
+		return 0, elapsed, err
+	}
+	return float64(n) / elapsed.Seconds(), elapsed, err
+}
+
+// RateForDeadline returns the rate (bytes/sec) needed to transfer bytes by
+// the deadline, or +Inf (unlimited) if the deadline has already passed.
+func RateForDeadline(bytes int64, by time.Time) float64 {
+	remaining := by.Sub(time.Now())
+	if remaining <= 0 {
+		return math.Inf(1)
+	}
+	return float64(bytes) / remaining.Seconds()
+}
+
+// SetMaxWriteLatency bounds the time a Write blocks for the rate limit to d:
+// a Write writes only the bytes the tokens available now and those earned
+// within d allow, at least one byte, and returns the count with no error, so
+// the caller writes the rest in further Writes. Unlike io.Writer, a short
+// write is therefore not an error; io.Copy and such will report
+// io.ErrShortWrite. The bound covers the rate limit of WithRateLimit or the
+// writer's own, the shared and the global limiters, and the packet overhead
+// of SetPacketModel. It sizes the write by the bytes of p, so that the cost
+// function of SetCostFunc, the post transform and the committed rate of
+// SetCIR may make a Write block longer. Zero disables it.
+func (s *Writer) SetMaxWriteLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxLatency = d
+}
+
+// latencyAllowance returns the bytes that may be written with ctx within the
+// maximum write latency, or 0 if not limited. It covers the rate limit of ctx
+// or the writer's own, the shared and the global limiters, and the packet
+// overhead.
+func (s *Writer) latencyAllowance(ctx context.Context) int {
+	s.mu.Lock()
+	d := s.maxLatency
+	s.mu.Unlock()
+	if d <= 0 {
+		return 0
+	}
+	n := math.Inf(1)
+	limiter := contextLimiter(ctx)
+	if limiter == nil {
+		limiter = s.getLimiter()
+	}
+	if limiter != nil && limiter.Limit() != rate.Inf {
+		n = limiter.TokensAt(s.now()) + float64(limiter.Limit())*d.Seconds()
+	}
+	if shared, _ := s.sharedLimiter(); shared != nil && s.committedLimiter() == nil {
+		n = math.Min(n, shared.allowance(d))
+	}
+	if s.global != nil {
+		n = math.Min(n, s.global.allowance(d))
+	}
+	if n > burstLimit {
+		return 0
+	}
+	n = s.payloadFor(n)
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// SetPostTransform sets f to transform the bytes of each Write, such as by
+// encryption, after the writer decides to write them. The transformed bytes
+// are written to the underlying writer and charged to the rate limit, so that
+// it applies to the bytes on the wire, while the writer reports the bytes of p
+// as written. If the transformed bytes are written partially, the writer
+// reports no bytes written with an error. nil removes the transform.
+func (s *Writer) SetPostTransform(f func(p []byte) ([]byte, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transform = f
+}
+
+func (s *Writer) postTransform() func(p []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transform
+}
+
+// transformed returns the result of a Write of p whose transformation q was
+// written n bytes with err.
+func transformed(p, q []byte, n int, err error) (int, error) {
+	if n == len(q) {
+		return len(p), err
+	}
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	return 0, err
+}
+
+// SetLeakyBucket switches the writer to leaky bucket mode: Writes queue up
+// to capacity bytes, and the queue drains to the underlying writer at the
+// rate limit in small even steps, so that bursts of Writes never reach the
+// underlying writer. Writes block while the queue is full, unless SetLossy
+// is enabled. Close waits for the queue to drain. Zero or less turns leaky
+// bucket mode off, once the queue drains; Writes in progress meanwhile may
+// return ErrClosed.
+func (s *Writer) SetLeakyBucket(capacity int) {
+	if capacity <= 0 {
+		if b := s.leakyBucket(); b != nil {
+			b.close()
+			s.mu.Lock()
+			if s.leaky == b {
+				s.leaky = nil
+			}
+			s.mu.Unlock()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leaky == nil {
+		s.leaky = newLeakyBucket(s, capacity)
+		return
+	}
+	s.leaky.mu.Lock()
+	s.leaky.capacity = capacity
+	s.leaky.cond.Broadcast()
+	s.leaky.mu.Unlock()
+}
+
+// SetLossy makes Writes in leaky bucket mode drop the bytes that do not fit
+// in the queue instead of blocking. Dropped bytes are reported as written.
+func (s *Writer) SetLossy(lossy bool) {
+	if b := s.leakyBucket(); b != nil {
+		b.mu.Lock()
+		b.lossy = lossy
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// SetFlushOnCancel makes the writer in leaky bucket mode flush the queued
+// bytes at once when its context is cancelled, instead of dropping them. The
+// flush may exceed the rate limit momentarily.
+func (s *Writer) SetFlushOnCancel(enabled bool) {
+	if b := s.leakyBucket(); b != nil {
+		b.mu.Lock()
+		b.flush = enabled
+		b.mu.Unlock()
+	}
+}
+
+// DroppedBytes returns the bytes dropped in lossy leaky bucket mode, or on
+// cancellation of the context without SetFlushOnCancel.
+func (s *Writer) DroppedBytes() int64 {
+	if b := s.leakyBucket(); b != nil {
+		return b.droppedBytes()
+	}
+	return 0
+}
+
+func (s *Writer) leakyBucket() *leakyBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaky
+}
+
+// Close flushes the write buffer, waits for the queue of leaky bucket mode to
+// drain, makes pending and further Writes return ErrClosed, closes the
+// underlying writer if it implements io.Closer, saves the bytes consumed to
+// the store of SetQuotaStore, and calls the function set by SetSummaryFunc.
+func (s *Writer) Close() error {
+	err := s.Flush()
+	if b := s.leakyBucket(); b != nil {
+		if berr := b.close(); err == nil {
+			err = berr
+		}
+	}
+	s.close()
+	if c, ok := s.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.saveQuota()
+	s.summarize()
+	return err
+}
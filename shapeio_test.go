@@ -3,11 +3,15 @@ package shapeio_test
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,6 +32,13 @@ var srcs = []*bytes.Reader{
 	bytes.NewReader(bytes.Repeat([]byte{2}, 1024*1024)), // 1MB
 }
 
+// newWriter returns a Writer discarding its writes at limit (bytes/sec).
+func newWriter(limit float64) *shapeio.Writer {
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateLimit(limit)
+	return w
+}
+
 func ExampleReader() {
 	// example for downloading http body with rate limit.
 	resp, _ := http.Get("http://example.com")
@@ -151,3 +162,362 @@ func TestConcurrentSetRateLimit(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestWriteAtRate(t *testing.T) {
+	limit := float64(500 * 1024) // 500KB/sec
+	achieved, elapsed, err := shapeio.WriteAtRate(ioutil.Discard, make([]byte, 256*1024), limit)
+	if err != nil {
+		t.Error("WriteAtRate failed", err)
+	}
+	if achieved > limit {
+		t.Errorf("Limit %f but achieved rate %f", limit, achieved)
+	}
+	if achieved < limit*0.9 {
+		t.Errorf("achieved rate %f is too far below limit %f", achieved, limit)
+	}
+	t.Logf("achieved %s/sec in %s", humanize.IBytes(uint64(achieved)), elapsed)
+}
+
+func TestWriteAtRateUnmeasured(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		size  int
+		limit float64
+	}{
+		{"empty", 0, 1024},
+		{"unlimited", 10, 0},
+	} {
+		achieved, _, err := shapeio.WriteAtRate(ioutil.Discard, make([]byte, c.size), c.limit)
+		if err != nil {
+			t.Errorf("%s: WriteAtRate failed: %s", c.name, err)
+		}
+		if math.IsNaN(achieved) || math.IsInf(achieved, 0) {
+			t.Errorf("%s: achieved rate %f", c.name, achieved)
+		}
+		if c.size == 0 && achieved != 0 {
+			t.Errorf("%s: achieved rate %f, want 0", c.name, achieved)
+		}
+	}
+}
+
+// eofReader returns its data together with io.EOF.
+type eofReader struct {
+	data []byte
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, io.EOF
+}
+
+func TestReadWithEOF(t *testing.T) {
+	limit := float64(10) // 10 bytes/sec
+	sio := shapeio.NewReader(&eofReader{data: []byte("hello")})
+	sio.SetRateLimit(limit)
+	p := make([]byte, 10)
+	start := time.Now()
+	n, err := sio.Read(p)
+	elapsed := time.Since(start)
+	if n != 5 || string(p[:n]) != "hello" {
+		t.Errorf("unexpected read %d %q", n, p[:n])
+	}
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("bytes read with io.EOF were not charged: %s", elapsed)
+	}
+}
+
+func TestConcurrentRead(t *testing.T) {
+	// run with go test -race
+	src := make([]byte, 1024*1024)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	sio := shapeio.NewReader(bytes.NewReader(src))
+	sio.SetRateLimit(50 * 1024 * 1024) // 50MB/sec
+
+	var mu sync.Mutex
+	var counts [256]int
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 4096)
+			for {
+				n, err := sio.Read(p)
+				mu.Lock()
+				for _, b := range p[:n] {
+					counts[b]++
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for b, c := range counts {
+		if c != len(src)/256 {
+			t.Errorf("byte %d was read %d times", b, c)
+		}
+	}
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { time.Sleep(w.stall) })
+	return len(p), nil
+}
+
+func TestMinReadSize(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789"), 1024) // 10KB
+	waits := func(minRead int) int64 {
+		sio := shapeio.NewReader(bytes.NewReader(src))
+		sio.SetRateLimit(1024 * 1024) // 1MB/sec
+		sio.SetMinReadSize(minRead)
+		var got []byte
+		p := make([]byte, 1)
+		for {
+			n, err := sio.Read(p)
+			got = append(got, p[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("unexpected data with MinReadSize %d", minRead)
+		}
+		return sio.Waits()
+	}
+
+	unbuffered := waits(0)
+	buffered := waits(1024)
+	if unbuffered < int64(len(src)) {
+		t.Errorf("%d waits for %d 1-byte reads", unbuffered, len(src))
+	}
+	if buffered > 11 {
+		t.Errorf("%d waits with MinReadSize 1024", buffered)
+	}
+}
+
+func TestMinReadSizeTryRead(t *testing.T) {
+	src := []byte("abcdefghijklmnop")
+	sio := shapeio.NewReader(bytes.NewReader(src))
+	sio.SetMinReadSize(8)
+	var got []byte
+	p := make([]byte, 2)
+	for len(got) < len(src) {
+		n, err := sio.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+		// the rest of the buffer comes before the stream
+		n, err = sio.TryRead(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+	}
+	if !bytes.Equal(got, src) {
+		t.Errorf("Read and TryRead delivered %q, want %q", got, src)
+	}
+}
+
+func TestRateForDeadline(t *testing.T) {
+	r := shapeio.RateForDeadline(100*1024, time.Now().Add(time.Second))
+	if r < 99*1024 || r > 101*1024 {
+		t.Errorf("unexpected rate %f for 100KB in 1s", r)
+	}
+	if r := shapeio.RateForDeadline(100*1024, time.Now().Add(-time.Second)); !math.IsInf(r, 1) {
+		t.Errorf("unexpected rate %f for a past deadline", r)
+	}
+
+	size := 50 * 1024
+	sio := shapeio.NewWriter(ioutil.Discard)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	sio.SetRateForDeadline(int64(size), deadline)
+	for i := 0; i < size; i += 5 * 1024 {
+		sio.Write(make([]byte, 5*1024))
+	}
+	if d := time.Since(deadline); d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Errorf("transfer completed %s off the deadline", d)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.reads > r.slowFrom && r.reads <= r.slowTo {
+		time.Sleep(r.delay)
+	}
+	return r.r.Read(p)
+}
+
+func TestSetHash(t *testing.T) {
+	src := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(src)
+	want := sha256.Sum256(src)
+
+	for _, minRead := range []int{0, 10 * 1024} {
+		sio := shapeio.NewReader(bytes.NewReader(src))
+		sio.SetRateLimit(512 * 1024) // 512KB/sec
+		sio.SetMinReadSize(minRead)
+		sio.SetHash(sha256.New())
+		buf := make([]byte, 3000)
+		for {
+			_, err := sio.Read(buf)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := sio.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Errorf("min read size %d: hash %x, want %x", minRead, got, want)
+		}
+	}
+}
+
+func (w *countingWait) Wait(ctx context.Context, d time.Duration) error {
+	atomic.AddInt32(&w.waits, 1)
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r delayReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestNilReaderWriter(t *testing.T) {
+	r := shapeio.NewReader(nil)
+	r.SetRateLimit(1024)
+	if _, err := r.Read(make([]byte, 10)); err != shapeio.ErrNilReader {
+		t.Errorf("Read of a nil reader returned %v", err)
+	}
+	w := shapeio.NewWriter(nil)
+	w.SetRateLimit(1024)
+	if _, err := w.Write(make([]byte, 10)); err != shapeio.ErrNilWriter {
+		t.Errorf("Write of a nil writer returned %v", err)
+	}
+}
+
+func TestReaderHidesWriterTo(t *testing.T) {
+	limit := float64(100 * 1024)                  // 100KB/sec
+	src := bytes.NewReader(make([]byte, 20*1024)) // implements io.WriterTo
+	sio := shapeio.NewReader(src)
+	sio.SetRateLimit(limit)
+	if _, ok := interface{}(sio).(io.WriterTo); ok {
+		t.Fatal("Reader implements io.WriterTo")
+	}
+	var dst bytes.Buffer // implements io.ReaderFrom
+	start := time.Now()
+	n, err := io.Copy(&dst, sio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realRate := float64(n) / time.Since(start).Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+}
+
+func TestSetExpectedDigest(t *testing.T) {
+	src := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(src)
+	sum := sha256.Sum256(src)
+
+	sio := shapeio.NewReader(bytes.NewReader(src))
+	sio.SetExpectedDigest(sha256.New(), sum[:])
+	if b, err := ioutil.ReadAll(sio); err != nil || !bytes.Equal(b, src) {
+		t.Errorf("read %d bytes, %v with the correct digest", len(b), err)
+	}
+
+	bad := sum
+	bad[0] ^= 0xff
+	sio = shapeio.NewReader(bytes.NewReader(src))
+	sio.SetExpectedDigest(sha256.New(), bad[:])
+	if _, err := ioutil.ReadAll(sio); err != shapeio.ErrDigestMismatch {
+		t.Errorf("ReadAll() = %v with an incorrect digest, want %v", err, shapeio.ErrDigestMismatch)
+	}
+}
+
+func TestSetMaxWriteLatency(t *testing.T) {
+	d := 100 * time.Millisecond
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(10 * 1024) // 10KB/sec
+	w.SetMaxWriteLatency(d)
+
+	src := make([]byte, 5*1024)
+	var writes int
+	for p := src; len(p) > 0; writes++ {
+		start := time.Now()
+		n, err := w.Write(p)
+		if elapsed := time.Since(start); elapsed > d+50*time.Millisecond {
+			t.Errorf("Write of %d bytes blocked %s", n, elapsed)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			t.Fatal("Write wrote nothing")
+		}
+		p = p[n:]
+	}
+	if dst.Len() != len(src) || writes < 4 {
+		t.Errorf("%d bytes in %d writes", dst.Len(), writes)
+	}
+}
+
+func TestSetMaxWriteLatencyLimiters(t *testing.T) {
+	d := 100 * time.Millisecond
+	for _, c := range []struct {
+		name  string
+		setup func(w *shapeio.Writer)
+	}{
+		{"shared", func(w *shapeio.Writer) {
+			w.SetSharedLimiter(shapeio.NewLimiter(10 * 1024)) // 10KB/sec
+		}},
+		{"packet overhead", func(w *shapeio.Writer) {
+			w.SetRateLimit(10 * 1024)  // 10KB/sec
+			w.SetPacketModel(100, 100) // half of the wire is overhead
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := shapeio.NewWriter(ioutil.Discard)
+			c.setup(w)
+			w.SetMaxWriteLatency(d)
+			for p := make([]byte, 3*1024); len(p) > 0; {
+				start := time.Now()
+				n, err := w.Write(p)
+				if elapsed := time.Since(start); elapsed > d+50*time.Millisecond {
+					t.Errorf("Write of %d bytes blocked %s", n, elapsed)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+		})
+	}
+}
@@ -0,0 +1,1019 @@
+package shapeio
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// CancelFunc returns the tokens held by a reservation to the limiter.
+type CancelFunc func()
+
+// shaper holds the rate limiting state shared by Reader and Writer.
+type shaper struct {
+	limiter *rate.Limiter
+	ctx     context.Context
+	custom  bool // created with a context
+	closed  bool
+	closing chan struct{} // closed on close
+	mu      sync.Mutex
+	iomu    sync.Mutex // serializes the underlying I/O
+	meter   meter
+	ioMeter ioMeter
+	total   int64
+	offBand int64
+	waits   int64
+	quota   *quota
+
+	ratePolicy      func(requested float64) float64
+	baseline        *float64
+	burst           int
+	burstMultiplier float64
+	rampDuration    time.Duration
+	ramp            *ramp
+
+	mtu      int
+	overhead int
+	costFunc func(p []byte) int
+
+	catchUp   bool
+	overshoot float64
+	peak      *rate.Limiter
+
+	saturationFunc func()
+	saturated      bool
+	progressFunc   func(ctx context.Context, total int64)
+
+	failRate float64
+	failErr  error
+	rnd      *rand.Rand
+
+	waitStrategy      WaitStrategy
+	timerWait         timerWait
+	keepaliveInterval time.Duration
+	keepalive         func() error
+
+	logger *log.Logger
+
+	shared       *Limiter
+	global       *Limiter // of SetGlobalRateLimit at construction
+	priority     int
+	bypassShared bool
+	committed    *rate.Limiter
+
+	accountant Accountant
+	tenant     string
+
+	initialDelay   time.Duration
+	startAlignment time.Duration
+	startAt        time.Time
+	slowStart      *slowStart
+
+	firstCall time.Time
+	firstByte time.Time
+
+	controller  RateController
+	thrash      thrashDetector
+	rateChanged chan struct{} // closed on a change of the rate limit
+	clock       Clock
+
+	created     time.Time
+	blocked     time.Duration
+	summaryFunc func(Summary)
+	summarized  bool
+	label       string
+
+	latencyFunc func() time.Duration
+
+	minRate float64 // bounds of StepUp and StepDown
+	maxRate float64
+}
+
+// defaultOvershoot is the default factor of the rate limit that catch-up
+// mode may reach.
+const defaultOvershoot = 2
+
+// peakBurst is the span of bandwidth that the peak rate of catch-up mode may
+// burst.
+const peakBurst = 20 * time.Millisecond
+
+// newShaper returns a shaper with ctx. It keeps ctx itself rather than a
+// context derived from it, which would stay registered with ctx until Close.
+func newShaper(ctx context.Context) shaper {
+	custom := ctx != context.Background()
+	return shaper{ctx: ctx, custom: custom, closing: make(chan struct{}), overshoot: defaultOvershoot, created: time.Now()}
+}
+
+// close cancels the pending waits and makes further transfers fail.
+func (s *shaper) close() {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if !closed {
+		close(s.closing)
+	}
+	s.deregister()
+}
+
+func (s *shaper) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// newLimiter returns a limiter without initial burst. Zero and MaxRate or
+// more mean no rate limit.
+func newLimiter(bytesPerSec float64) *rate.Limiter {
+	return newLimiterAt(bytesPerSec, time.Now())
+}
+
+// newLimiterAt is like newLimiter, but spends the initial burst at now.
+func newLimiterAt(bytesPerSec float64, now time.Time) *rate.Limiter {
+	limit := rate.Limit(bytesPerSec)
+	if bytesPerSec == 0 || bytesPerSec >= MaxRate {
+		limit = rate.Inf
+	}
+	l := rate.NewLimiter(limit, burstLimit)
+	l.AllowN(now, burstLimit) // spend initial burst
+	return l
+}
+
+// bytesFor returns the bytes transferred over d at bytesPerSec, between 1
+// and burstLimit.
+func bytesFor(bytesPerSec float64, d time.Duration) int {
+	n := bytesPerSec * d.Seconds()
+	switch {
+	case n < 1:
+		return 1
+	case n > burstLimit:
+		return burstLimit
+	}
+	return int(n)
+}
+
+func (s *shaper) setRateLimit(bytesPerSec float64) error {
+	s.mu.Lock()
+	err := s.applyRateLimit(bytesPerSec)
+	thrashed := s.thrash.count(time.Now())
+	s.mu.Unlock()
+	if thrashed != nil {
+		thrashed()
+	}
+	return err
+}
+
+// swapRateLimit sets rate limit (bytes/sec) and returns the previous one, or 0
+// if it was unlimited.
+func (s *shaper) swapRateLimit(bytesPerSec float64) float64 {
+	s.mu.Lock()
+	prev := s.targetRate()
+	s.applyRateLimit(bytesPerSec)
+	thrashed := s.thrash.count(time.Now())
+	s.mu.Unlock()
+	if thrashed != nil {
+		thrashed()
+	}
+	return prev
+}
+
+// targetRate returns the rate limit (bytes/sec) set last, the end of the ramp
+// if any, or 0 if unlimited. s.mu must be held.
+func (s *shaper) targetRate() float64 {
+	switch {
+	case s.ramp != nil:
+		return s.ramp.to
+	case s.limiter == nil:
+		return 0
+	}
+	return float64(s.limiter.Limit())
+}
+
+func (s *shaper) getRateLimit() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.targetRate()
+}
+
+// applyRateLimit sets rate limit (bytes/sec). s.mu must be held.
+func (s *shaper) applyRateLimit(bytesPerSec float64) error {
+	var err error
+	if math.IsNaN(bytesPerSec) || bytesPerSec < 0 {
+		bytesPerSec, err = 0, ErrInvalidRate
+	}
+
+	if s.ratePolicy != nil {
+		if bytesPerSec == 0 {
+			bytesPerSec = math.Inf(1)
+		}
+		bytesPerSec = s.ratePolicy(bytesPerSec)
+		if math.IsNaN(bytesPerSec) || bytesPerSec < 0 {
+			bytesPerSec, err = 0, ErrInvalidRate
+		}
+	}
+
+	if s.rateChanged != nil {
+		// rescale the pending waits
+		close(s.rateChanged)
+		s.rateChanged = nil
+	}
+	if s.controller != nil {
+		if bytesPerSec >= MaxRate {
+			s.controller.SetRate(0)
+		} else {
+			s.controller.SetRate(bytesPerSec)
+		}
+	}
+	s.ramp = nil
+	switch {
+	case bytesPerSec == 0 || bytesPerSec >= MaxRate:
+		s.limiter = nil
+	case s.limiter == nil:
+		s.limiter = newLimiterAt(bytesPerSec, s.now())
+	case s.rampDuration > 0:
+		s.ramp = &ramp{
+			from:     float64(s.limiter.Limit()),
+			to:       bytesPerSec,
+			start:    s.now(),
+			duration: s.rampDuration,
+		}
+	default:
+		s.limiter.SetLimitAt(s.now(), rate.Limit(bytesPerSec))
+	}
+	s.applyBurst()
+	return err
+}
+
+func (s *shaper) setBurst(n int) {
+	if n <= 0 || n > burstLimit {
+		n = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.burst = n
+	s.applyBurst()
+}
+
+func (s *shaper) setBurstMultiplier(m float64) {
+	if math.IsNaN(m) || m < 0 {
+		m = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.burstMultiplier = m
+	s.applyBurst()
+}
+
+// applyBurst sets the burst size to the limiter. s.mu must be held.
+func (s *shaper) applyBurst() {
+	if s.limiter != nil {
+		if burst := s.burstSize(); s.limiter.Burst() != burst {
+			s.limiter.SetBurstAt(s.now(), burst)
+		}
+	}
+}
+
+func (s *shaper) getBurst() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.burstSize()
+}
+
+// burstSize returns the burst size. s.mu must be held.
+func (s *shaper) burstSize() int {
+	if s.burst > 0 {
+		return s.burst
+	}
+	if s.burstMultiplier > 0 && s.limiter != nil {
+		burst := float64(s.limiter.Limit()) * s.burstMultiplier
+		if burst < 1 {
+			return 1
+		}
+		if burst < burstLimit {
+			return int(burst)
+		}
+	}
+	return burstLimit
+}
+
+func (s *shaper) setInitialDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initialDelay = d
+}
+
+func (s *shaper) setStartAlignment(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startAlignment = d
+}
+
+// startDelay returns the remaining initial delay. The first call starts it.
+func (s *shaper) startDelay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.startAt.IsZero() {
+		s.startAt = now.Add(s.initialDelay)
+		if d := s.startAlignment; d > 0 {
+			if aligned := s.startAt.Truncate(d); aligned.Before(s.startAt) {
+				s.startAt = aligned.Add(d)
+			}
+		}
+	}
+	if s.firstCall.IsZero() {
+		s.firstCall = now
+	}
+	return s.startAt.Sub(now)
+}
+
+// firstByteLatency returns the time from the first transfer call to the first
+// byte transferred, or 0 if no byte has been transferred.
+func (s *shaper) firstByteLatency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firstCall.IsZero() || s.firstByte.IsZero() {
+		return 0
+	}
+	return s.firstByte.Sub(s.firstCall)
+}
+
+// waitStart waits for the initial delay.
+func (s *shaper) waitStart(ctx context.Context) error {
+	if d := s.startDelay(); d > 0 {
+		return s.sleep(ctx, d)
+	}
+	return nil
+}
+
+func (s *shaper) setLatencyFunc(f func() time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencyFunc = f
+}
+
+// waitLatency waits for the simulated latency of a chunk. The tokens earned
+// meanwhile are discarded, so that the latency adds to the time of the rate
+// limit rather than overlapping it.
+func (s *shaper) waitLatency(ctx context.Context) error {
+	s.mu.Lock()
+	f := s.latencyFunc
+	s.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	d := f()
+	if d <= 0 {
+		return nil
+	}
+	limiter, tokens := s.pauseTokens()
+	defer s.resumeTokens(limiter, tokens)
+	return s.sleep(ctx, d)
+}
+
+func (s *shaper) setCostFunc(f func(p []byte) int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.costFunc = f
+}
+
+func (s *shaper) hasCostFunc() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.costFunc != nil
+}
+
+// cost returns the bandwidth consumed by transferring p.
+func (s *shaper) cost(p []byte) int {
+	s.mu.Lock()
+	f := s.costFunc
+	s.mu.Unlock()
+	n := len(p)
+	if f != nil && n > 0 {
+		n = f(p)
+	}
+	return n + s.packetOverhead(len(p))
+}
+
+func (s *shaper) setRatePolicy(policy func(requested float64) float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ratePolicy = policy
+}
+
+func (s *shaper) setBaselineRate(bytesPerSec float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.baseline = &bytesPerSec
+}
+
+func (s *shaper) restoreBaseline() error {
+	s.mu.Lock()
+	baseline := s.baseline
+	s.mu.Unlock()
+	if baseline == nil {
+		return nil
+	}
+	return s.setRateLimit(*baseline)
+}
+
+func (s *shaper) setRampDuration(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rampDuration = d
+}
+
+// record accounts n transferred bytes in the statistics and the quota.
+func (s *shaper) record(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.total += int64(n)
+	if s.firstByte.IsZero() {
+		s.firstByte = now
+	}
+	var saturated func()
+	if s.meter.add(now, n) && s.saturationFunc != nil && !s.saturated && s.limiter != nil &&
+		s.meter.rate >= saturationRatio*float64(s.limiter.Limit()) {
+		s.saturated = true
+		saturated = s.saturationFunc
+	}
+	progress, total := s.progressFunc, s.total
+	q := s.quota
+	save := q != nil && q.consume(now, n)
+	var used int64
+	if save {
+		used = q.used
+	}
+	s.mu.Unlock()
+
+	if saturated != nil {
+		saturated()
+	}
+	if progress != nil {
+		progress(s.ctx, total)
+	}
+	if save {
+		q.store.Save(used)
+	}
+}
+
+func (s *shaper) setSaturationFunc(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saturationFunc = f
+}
+
+func (s *shaper) setProgressFunc(f func(ctx context.Context, total int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progressFunc = f
+}
+
+func (s *shaper) currentRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meter.roll(time.Now())
+	return s.meter.current()
+}
+
+func (s *shaper) peakRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meter.roll(time.Now())
+	return s.meter.peak
+}
+
+// describe returns a summary of the configuration and statistics of the
+// wrapper of kind.
+func (s *shaper) describe(kind string) string {
+	now := time.Now()
+	s.mu.Lock()
+	limit := "unlimited"
+	if s.limiter != nil {
+		limit = fmt.Sprintf("%.0fB/s", float64(s.limiter.Limit()))
+	}
+	burst, chunk := s.burstSize(), s.burstSize()
+	if s.mtu > 0 && s.mtu < chunk {
+		chunk = s.mtu
+	}
+	s.meter.roll(now)
+	current, total := s.meter.current(), s.total
+	s.mu.Unlock()
+
+	size := func(n int) string {
+		if n >= burstLimit {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%dB", n)
+	}
+	ctx := "background"
+	if deadline, ok := s.ctx.Deadline(); ok {
+		ctx = "deadline " + deadline.Format(time.RFC3339)
+	} else if s.custom {
+		ctx = "custom"
+	}
+	if s.isClosed() {
+		ctx += ", closed"
+	}
+	return fmt.Sprintf("shapeio.%s{rate: %s, burst: %s, chunk: %s, context: %s, total: %dB, current: %.0fB/s}",
+		kind, limit, size(burst), size(chunk), ctx, total, current)
+}
+
+func (s *shaper) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meter = meter{alpha: s.meter.alpha}
+	s.ioMeter = ioMeter{}
+	s.total = 0
+	s.saturated = false
+	s.firstCall, s.firstByte = time.Time{}, time.Time{}
+}
+
+// recordIO records n bytes transferred by the underlying I/O started at
+// start.
+func (s *shaper) recordIO(start time.Time, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ioMeter.add(start, time.Now(), n)
+}
+
+func (s *shaper) shapedRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ioMeter.rate(time.Now())
+}
+
+func (s *shaper) setFailureRate(p float64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRate = p
+	s.failErr = err
+}
+
+func (s *shaper) setFailureSeed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rnd = rand.New(rand.NewSource(seed))
+}
+
+// fail returns the injected error if the operation has been chosen to fail.
+func (s *shaper) fail() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failRate <= 0 {
+		return nil
+	}
+	if s.rnd == nil {
+		s.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if s.rnd.Float64() < s.failRate {
+		return s.failErr
+	}
+	return nil
+}
+
+func (s *shaper) getLimiter() *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ramp != nil {
+		now := s.now()
+		limit, done := s.ramp.at(now)
+		s.limiter.SetLimitAt(now, rate.Limit(limit))
+		s.applyBurst()
+		if done {
+			s.ramp = nil
+		}
+	}
+	return s.limiter
+}
+
+// wait blocks until n bytes may be transferred.
+// A rate limit carried by ctx takes precedence over the wrapper's own.
+func (s *shaper) wait(ctx context.Context, n int) error {
+	limiter := contextLimiter(ctx)
+	var controller RateController
+	if limiter == nil {
+		if controller = s.getController(); controller == nil {
+			limiter = s.getLimiter()
+		}
+	}
+	shared, priority := s.sharedLimiter()
+	committed := s.committedLimiter()
+	if limiter == nil && controller == nil && shared == nil && committed == nil && s.global == nil || n <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	s.waits++
+	s.mu.Unlock()
+	defer s.addBlocked(time.Now())
+	if controller != nil {
+		if err := s.waitController(ctx, controller, n); err != nil {
+			return err
+		}
+	}
+	if limiter != nil {
+		if err := s.waitLimiter(ctx, limiter, n); err != nil {
+			return err
+		}
+		if peak := s.peakLimiter(limiter); peak != nil {
+			if err := s.waitLimiter(ctx, peak, n); err != nil {
+				return err
+			}
+		}
+	}
+	if committed != nil {
+		// the shared limiter serves as the excess pool
+		if err := s.waitCommitted(ctx, committed, shared, n); err != nil {
+			return err
+		}
+	} else if shared != nil {
+		if err := s.waitShared(ctx, shared, priority, n); err != nil {
+			return err
+		}
+	}
+	if s.global != nil {
+		return s.waitShared(ctx, s.global, priority, n)
+	}
+	return nil
+}
+
+func (s *shaper) setCatchUp(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catchUp = enabled
+}
+
+func (s *shaper) setCatchUpOvershoot(factor float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overshoot = factor
+}
+
+// peakLimiter returns the limiter capping the peak rate in catch-up mode,
+// if limiter is the wrapper's own.
+func (s *shaper) peakLimiter(limiter *rate.Limiter) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.catchUp || limiter != s.limiter {
+		return nil
+	}
+	limit := limiter.Limit() * rate.Limit(s.overshoot)
+	burst := bytesFor(float64(limit), peakBurst)
+	now := time.Now()
+	if s.peak == nil {
+		s.peak = rate.NewLimiter(limit, burst)
+		s.peak.AllowN(now, burst) // spend initial burst
+	} else if s.peak.Limit() != limit || s.peak.Burst() != burst {
+		s.peak.SetLimitAt(now, limit)
+		s.peak.SetBurstAt(now, burst)
+	}
+	return s.peak
+}
+
+// waitLimiter waits for n tokens of limiter until ctx is done or the wrapper
+// is closed. Waits for more tokens than the burst are split.
+func (s *shaper) waitLimiter(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		m := n
+		if burst := limiter.Burst(); m > burst && limiter.Limit() != rate.Inf {
+			m = burst
+		}
+		if err := s.waitTokens(ctx, limiter, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// waitTokens waits for n tokens of limiter, no more than its burst.
+func (s *shaper) waitTokens(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if err := s.done(ctx); err != nil {
+		return err
+	}
+	now := s.now()
+	logger := s.getLogger()
+	var tokens float64
+	if logger != nil {
+		tokens = limiter.TokensAt(now)
+	}
+	r := limiter.ReserveN(now, n)
+	if !r.OK() {
+		return fmt.Errorf("shapeio: wait(n=%d) exceeds limiter's burst %d", n, limiter.Burst())
+	}
+	delay := r.DelayFrom(now)
+	if logger != nil {
+		logger.Printf("shapeio: wait n=%d tokens=%.0f delay=%s", n, tokens, delay)
+	}
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		r.CancelAt(now)
+		return context.DeadlineExceeded
+	}
+	if err := s.throttleTokens(ctx, limiter, delay); err != nil {
+		r.Cancel()
+		return err
+	}
+	return nil
+}
+
+// throttleTokens sleeps for delay imposed by limiter. When the rate limit is
+// changed meanwhile, the rest of the delay is rescaled to the new rate, as the
+// tokens owed are repaid at it, so that the waits still end in the order they
+// were reserved. The delays of other limiters, such as of messages or ctx,
+// are not owed to the rate limit and are kept.
+func (s *shaper) throttleTokens(ctx context.Context, limiter *rate.Limiter, delay time.Duration) error {
+	own := s.getLimiter() == limiter
+	limit := limiter.Limit()
+	for {
+		s.mu.Lock()
+		if s.rateChanged == nil {
+			s.rateChanged = make(chan struct{})
+		}
+		changed := s.rateChanged
+		s.mu.Unlock()
+
+		start := s.now()
+		if err := s.throttle(ctx, delay, changed); err != errRateChanged {
+			return err
+		}
+		remaining := delay - s.now().Sub(start)
+		if !own {
+			if remaining <= 0 {
+				return nil
+			}
+			delay = remaining
+			continue
+		}
+		if s.getLimiter() != limiter {
+			return nil // removed or replaced
+		}
+		newLimit := limiter.Limit()
+		if remaining <= 0 || newLimit == rate.Inf {
+			return nil
+		}
+		delay = time.Duration(float64(remaining) * float64(limit) / float64(newLimit))
+		limit = newLimit
+	}
+}
+
+func (s *shaper) setLogger(logger *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+func (s *shaper) getLogger() *log.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logger
+}
+
+// done returns the error for a transfer with ctx, if it must not proceed.
+func (s *shaper) done(ctx context.Context) error {
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.ctx.Err()
+}
+
+func (s *shaper) waitCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waits
+}
+
+// allow reports whether n bytes may be transferred immediately, consuming
+// the tokens if so. The tokens of the limiters shared with other wrappers are
+// taken only if the wrapper's own allow n bytes.
+func (s *shaper) allow(n int) bool {
+	if !s.available(n) || !s.poolsAvailable(n) {
+		return false
+	}
+	if c := s.getController(); c != nil {
+		if !c.AllowN(s.now(), n) {
+			return false
+		}
+	} else if limiter := s.getLimiter(); limiter != nil && !limiter.AllowN(s.now(), n) {
+		return false
+	}
+	s.chargePools(n)
+	return true
+}
+
+// available reports whether the wrapper's own rate limit has n tokens
+// available without consuming them. A controller is only asked by AllowN.
+func (s *shaper) available(n int) bool {
+	if s.getController() != nil {
+		return true
+	}
+	limiter := s.getLimiter()
+	if limiter == nil {
+		return true
+	}
+	return limiter.TokensAt(s.now()) >= float64(n)
+}
+
+// poolsAvailable reports whether the limiters shared with other wrappers, and
+// the committed rate of SetCIR, have n tokens available without consuming
+// them.
+func (s *shaper) poolsAvailable(n int) bool {
+	shared, _ := s.sharedLimiter()
+	if committed := s.committedLimiter(); committed != nil {
+		// the shared limiter serves as the excess pool
+		if committed.TokensAt(time.Now()) < float64(n) && (shared == nil || !shared.available(n)) {
+			return false
+		}
+	} else if shared != nil && !shared.available(n) {
+		return false
+	}
+	return s.global == nil || s.global.available(n)
+}
+
+// chargePools consumes n tokens of the limiters shared with other wrappers,
+// and of the committed rate of SetCIR.
+func (s *shaper) chargePools(n int) {
+	shared, _ := s.sharedLimiter()
+	if committed := s.committedLimiter(); committed != nil {
+		now := time.Now()
+		if committed.TokensAt(now) >= float64(n) || shared == nil {
+			burnTokens(committed, now, float64(n))
+		} else {
+			shared.charge(n)
+		}
+	} else if shared != nil {
+		shared.charge(n)
+	}
+	if s.global != nil {
+		s.global.charge(n)
+	}
+}
+
+// rateLimit returns the current rate limit (bytes/sec), or 0 if unlimited.
+func (s *shaper) rateLimit() float64 {
+	limiter := s.getLimiter()
+	if limiter == nil {
+		return 0
+	}
+	return float64(limiter.Limit())
+}
+
+// pauseTokens returns the limiter and its tokens before blocking on the
+// underlying I/O, to be passed to resumeTokens afterwards.
+func (s *shaper) pauseTokens() (*rate.Limiter, float64) {
+	limiter := s.getLimiter()
+	if limiter == nil || s.catchingUp() {
+		return nil, 0
+	}
+	return limiter, limiter.TokensAt(s.now())
+}
+
+func (s *shaper) catchingUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.catchUp
+}
+
+// resumeTokens discards the tokens earned while blocked on the underlying
+// I/O, so that a stalled transfer does not burst over the rate limit when it
+// catches up.
+func (s *shaper) resumeTokens(limiter *rate.Limiter, before float64) {
+	if limiter == nil {
+		return
+	}
+	now := s.now()
+	burnTokens(limiter, now, limiter.TokensAt(now)-before)
+}
+
+// burnTokens consumes n tokens of limiter at now, in burst-sized pieces.
+func burnTokens(limiter *rate.Limiter, now time.Time, n float64) {
+	for burst := float64(limiter.Burst()); n >= 1; n -= burst {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		limiter.ReserveN(now, int(m))
+	}
+}
+
+// tokens returns the bytes that may be transferred immediately.
+func (s *shaper) tokens() float64 {
+	if c := s.getController(); c != nil {
+		return c.Tokens()
+	}
+	limiter := s.getLimiter()
+	if limiter == nil {
+		return math.Inf(1)
+	}
+	return limiter.TokensAt(s.now())
+}
+
+// charge consumes n tokens without waiting for them.
+func (s *shaper) charge(n int) {
+	limiter := s.getLimiter()
+	if limiter == nil || n <= 0 {
+		return
+	}
+	limiter.ReserveN(s.now(), n)
+}
+
+// spend waits for and consumes n tokens without transferring data.
+func (s *shaper) spend(n int64) error {
+	if err := s.wait(s.ctx, int(n)); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offBand += n
+	return nil
+}
+
+func (s *shaper) offBandBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offBand
+}
+
+func (s *shaper) reserve(n int64) (time.Duration, CancelFunc) {
+	limiter := s.getLimiter()
+	if limiter == nil {
+		return 0, func() {}
+	}
+	now := s.now()
+	// n tokens more than the burst are owed by one reservation as by the
+	// burst-sized pieces of wait, so that it can be cancelled at once; the
+	// burst is raised for it only, after the tokens are capped at it
+	s.mu.Lock()
+	burst, limit := limiter.Burst(), limiter.Limit()
+	raise := n > int64(burst) && limit > 0 && limit != rate.Inf
+	if raise {
+		limiter.SetBurstAt(now, burst)
+		limiter.SetBurstAt(now, int(n))
+	}
+	r := limiter.ReserveN(now, int(n))
+	if raise {
+		limiter.SetBurstAt(now, burst)
+	}
+	s.mu.Unlock()
+	if !r.OK() {
+		return rate.InfDuration, func() {}
+	}
+	return r.DelayFrom(now), func() { r.CancelAt(s.now()) }
+}
+
+// wouldBlock returns the delay a transfer of n bytes would wait for now,
+// without consuming tokens.
+func (s *shaper) wouldBlock(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	var delay time.Duration
+	if c := s.getController(); c != nil {
+		delay = tokenDelay(c.Tokens(), s.getRateLimit(), n)
+	} else if limiter := s.getLimiter(); limiter != nil {
+		delay = tokenDelay(limiter.TokensAt(s.now()), float64(limiter.Limit()), n)
+	}
+	now := time.Now()
+	shared, _ := s.sharedLimiter()
+	var d time.Duration
+	if committed := s.committedLimiter(); committed != nil {
+		d = tokenDelay(committed.TokensAt(now), float64(committed.Limit()), n)
+		// the shared limiter serves as the excess pool
+		if d > 0 && shared != nil && shared.delay(now, n) == 0 {
+			d = 0
+		}
+	} else if shared != nil {
+		d = shared.delay(now, n)
+	}
+	if s.global != nil {
+		if g := s.global.delay(now, n); g > d {
+			d = g
+		}
+	}
+	if d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// tokenDelay returns the time for tokens to reach n at limit (bytes/sec).
+func tokenDelay(tokens, limit float64, n int) time.Duration {
+	if tokens >= float64(n) || limit <= 0 || math.IsInf(limit, 1) {
+		return 0
+	}
+	return time.Duration((float64(n) - tokens) / limit * float64(time.Second))
+}
@@ -0,0 +1,632 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestReserve(t *testing.T) {
+	limit := float64(1024 * 1024) // 1MB/sec
+	sio := newWriter(limit)
+
+	delay, cancel := sio.Reserve(2 * 1024 * 1024)
+	if delay < 1900*time.Millisecond || delay > 2*time.Second {
+		t.Errorf("unexpected delay %s for 2MB at 1MB/sec", delay)
+	}
+	cancel()
+
+	// tokens were returned, so the same reservation costs the same again
+	delay, cancel = sio.Reserve(2 * 1024 * 1024)
+	defer cancel()
+	if delay > 2*time.Second {
+		t.Errorf("tokens were not restored: delay %s", delay)
+	}
+}
+
+func TestReserveBurst(t *testing.T) {
+	sio := newWriter(10 * 1024) // 10KB/sec
+	sio.SetBurst(1024)
+
+	// more than the burst is reserved in pieces, as Write waits for it
+	delay, cancel := sio.Reserve(4 * 1024)
+	if delay < 350*time.Millisecond || delay > 450*time.Millisecond {
+		t.Errorf("delay %s for 4KB at 10KB/sec with 1KB burst, want 400ms", delay)
+	}
+	cancel()
+	if delay, cancel := sio.Reserve(1024); delay > 150*time.Millisecond {
+		t.Errorf("tokens were not restored: delay %s for 1KB", delay)
+	} else {
+		cancel()
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	sio := newWriter(100 * 1024) // 100KB/sec
+	if _, err := sio.TryWrite(make([]byte, 1024)); err != shapeio.ErrWouldBlock {
+		t.Errorf("expected ErrWouldBlock with no tokens, got %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond) // accumulate about 20KB
+	n, err := sio.TryWrite(make([]byte, 10*1024))
+	if err != nil {
+		t.Errorf("TryWrite failed with tokens available: %s", err)
+	}
+	if n != 10*1024 {
+		t.Errorf("unexpected written bytes %d", n)
+	}
+	if _, err := sio.TryWrite(make([]byte, 50*1024)); err != shapeio.ErrWouldBlock {
+		t.Errorf("expected ErrWouldBlock when tokens are short, got %v", err)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	errFlaky := errors.New("flaky link")
+
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 1024)))
+	sio.SetFailureSeed(1)
+	sio.SetFailureRate(1, errFlaky)
+	for i := 0; i < 10; i++ {
+		if n, err := sio.Read(make([]byte, 10)); err != errFlaky || n != 0 {
+			t.Errorf("expected injected error, got %d %v", n, err)
+		}
+	}
+
+	sio.SetFailureRate(0, errFlaky)
+	n, err := io.Copy(ioutil.Discard, sio)
+	if err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if n != 1024 {
+		t.Errorf("unexpected read bytes %d", n)
+	}
+}
+
+func TestSpendTokens(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	write := func(spend int64) time.Duration {
+		sio := newWriter(limit)
+		time.Sleep(500 * time.Millisecond) // accumulate about 50KB
+		if err := sio.SpendTokens(spend); err != nil {
+			t.Fatal(err)
+		}
+		if n := sio.OffBandBytes(); n != spend {
+			t.Errorf("OffBandBytes %d, expected %d", n, spend)
+		}
+		start := time.Now()
+		sio.Write(make([]byte, 40*1024))
+		return time.Since(start)
+	}
+
+	free := write(0)
+	spent := write(40 * 1024)
+	if spent < free+250*time.Millisecond {
+		t.Errorf("SpendTokens did not reduce throughput: %s vs %s", spent, free)
+	}
+}
+
+func TestSetRateLimitInvalid(t *testing.T) {
+	// unlimited reports whether w writes 1KB without waiting
+	unlimited := func(w *shapeio.Writer) bool {
+		start := time.Now()
+		w.Write(make([]byte, 1024))
+		return time.Since(start) <= 100*time.Millisecond
+	}
+
+	for _, limit := range []float64{math.NaN(), -1, math.Inf(-1)} {
+		// SetRateLimit removes the rate limit silently
+		sio := newWriter(1) // 1 byte/sec
+		sio.SetRateLimit(limit)
+		if !unlimited(sio) {
+			t.Errorf("SetRateLimit(%f) is not unlimited", limit)
+		}
+
+		sio = newWriter(1) // 1 byte/sec is replaced by unlimited
+		if err := sio.SetRateLimitErr(limit); err != shapeio.ErrInvalidRate {
+			t.Errorf("SetRateLimitErr(%f) returned %v", limit, err)
+		}
+		if !unlimited(sio) {
+			t.Errorf("SetRateLimitErr(%f) is not unlimited", limit)
+		}
+	}
+
+	for _, limit := range []float64{0, math.Inf(1)} {
+		sio := newWriter(1) // 1 byte/sec
+		if err := sio.SetRateLimitErr(limit); err != nil {
+			t.Errorf("SetRateLimitErr(%f) returned %v", limit, err)
+		}
+		if !unlimited(sio) {
+			t.Errorf("SetRateLimit(%f) is not unlimited", limit)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	if tokens := sio.Tokens(); !math.IsInf(tokens, 1) {
+		t.Errorf("Tokens %f without rate limit", tokens)
+	}
+
+	sio.SetRateLimit(100 * 1024) // 100KB/sec
+	time.Sleep(200 * time.Millisecond)
+	before := sio.Tokens()
+	if before < 15*1024 {
+		t.Errorf("Tokens %f did not replenish", before)
+	}
+	sio.Write(make([]byte, 10*1024))
+	after := sio.Tokens()
+	if after > before-9*1024 {
+		t.Errorf("Tokens did not decrease after Write: %f -> %f", before, after)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tokens := sio.Tokens(); tokens < after+9*1024 {
+		t.Errorf("Tokens did not replenish: %f -> %f", after, tokens)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	sio := shapeio.NewWriter(ioutil.Discard)
+	if l := sio.Limiter(); l != nil {
+		t.Error("Limiter must be nil without rate limit")
+	}
+	sio.SetRateLimit(100 * 1024) // 100KB/sec
+	r := sio.Limiter().ReserveN(time.Now(), 20*1024)
+	if !r.OK() {
+		t.Fatal("ReserveN failed")
+	}
+
+	// the Write waits behind the reservation
+	start := time.Now()
+	sio.Write(make([]byte, 10*1024))
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Write did not wait for the reservation: %s", elapsed)
+	}
+}
+
+// stallWriter blocks its first Write for a while.
+type stallWriter struct {
+	stall time.Duration
+	once  sync.Once
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	sio := shapeio.NewWriter(&stallWriter{stall: 500 * time.Millisecond})
+	sio.SetRateLimit(limit)
+	sio.Write(make([]byte, 1024))
+
+	// the stall must not have earned a burst of 50KB
+	start := time.Now()
+	n, _ := sio.Write(make([]byte, 50*1024))
+	elapsed := time.Since(start)
+	realRate := float64(n) / elapsed.Seconds()
+	if realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f after backpressure", limit, realRate)
+	}
+}
+
+// slowReader is slow on the reads from slowFrom to slowTo.
+type slowReader struct {
+	r        io.Reader
+	reads    int
+	slowFrom int
+	slowTo   int
+	delay    time.Duration
+}
+
+func TestCatchUp(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	overshoot := 2.0
+	src := &slowReader{
+		r:        bytes.NewReader(make([]byte, 240*1024)),
+		slowFrom: 10,
+		slowTo:   20,
+		delay:    100 * time.Millisecond, // 40KB/sec
+	}
+	sio := shapeio.NewReader(src)
+	sio.SetRateLimit(limit)
+	sio.SetCatchUp(true)
+	sio.SetCatchUpOvershoot(overshoot)
+
+	start := time.Now()
+	n, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{sio}, make([]byte, 4*1024))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avg := float64(n) / elapsed.Seconds()
+	if avg < limit*0.9 || avg > limit*1.05 {
+		t.Errorf("average rate %f did not converge to %f", avg, limit)
+	}
+	if peak := sio.PeakRate(); peak > limit*overshoot*1.15 {
+		t.Errorf("peak rate %f exceeds the overshoot bound", peak)
+	}
+}
+
+func TestSetRatePolicy(t *testing.T) {
+	ceiling := float64(1024 * 1024) // 1MB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRatePolicy(func(requested float64) float64 {
+		return math.Min(requested, ceiling)
+	})
+	for _, c := range []struct {
+		requested, applied float64
+	}{
+		{512 * 1024, 512 * 1024},
+		{2 * 1024 * 1024, ceiling},
+		{math.Inf(1), ceiling},
+		{0, ceiling},
+	} {
+		if err := w.SetRateLimitErr(c.requested); err != nil {
+			t.Fatal(err)
+		}
+		if limiter := w.Limiter(); limiter == nil || float64(limiter.Limit()) != c.applied {
+			t.Errorf("SetRateLimit(%f) applied %v, want %f", c.requested, limiter, c.applied)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var logs bytes.Buffer
+	w := newWriter(100 * 1024) // 100KB/sec
+	for i := 0; i < 3; i++ {
+		w.Write(make([]byte, 1024))
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("logged without a logger: %q", logs.String())
+	}
+
+	w.SetLogger(log.New(&logs, "", 0))
+	for i := 0; i < 3; i++ {
+		w.Write(make([]byte, 1024))
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("logged %d decisions, want 3: %q", len(lines), logs.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "n=1024") || !strings.Contains(line, "delay=") {
+			t.Errorf("unexpected log: %q", line)
+		}
+	}
+}
+
+func TestBurst(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	burst := 4 * 1024
+	rec := &recordingWriter{}
+	sio := shapeio.NewWriter(rec)
+	sio.SetRateLimit(limit)
+	sio.SetBurst(burst)
+	if b := sio.Burst(); b != burst {
+		t.Fatalf("Burst() = %d, want %d", b, burst)
+	}
+
+	// a single large write, like a flush of a compressor
+	start := time.Now()
+	n, err := sio.Write(make([]byte, 32*1024))
+	if err != nil || n != 32*1024 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	var sent int
+	for i, size := range rec.sizes {
+		if size > burst {
+			t.Fatalf("wrote %d bytes at once, exceeding the burst %d", size, burst)
+		}
+		sent += size
+		elapsed := rec.times[i].Sub(start).Seconds()
+		if allowed := float64(burst) + limit*elapsed; float64(sent) > allowed*1.05 {
+			t.Errorf("%d bytes sent after %fs, exceeding the cap", sent, elapsed)
+		}
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	delay := 200 * time.Millisecond
+	sio := shapeio.NewReader(zeroReader{})
+	sio.SetInitialDelay(delay)
+	buf := make([]byte, 1024)
+
+	start := time.Now()
+	sio.Read(buf)
+	if elapsed := time.Since(start); elapsed < delay || elapsed > delay+100*time.Millisecond {
+		t.Errorf("first Read took %s, want about %s", elapsed, delay)
+	}
+	start = time.Now()
+	sio.Read(buf)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("second Read delayed by %s", elapsed)
+	}
+}
+
+func TestInitialDelayContext(t *testing.T) {
+	sio := shapeio.NewReader(zeroReader{})
+	sio.SetInitialDelay(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sio.ReadContext(ctx, make([]byte, 1024)); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ReadContext ignored the deadline: %s", elapsed)
+	}
+}
+
+func TestRestoreBaseline(t *testing.T) {
+	baseline := float64(100 * 1024) // 100KB/sec
+	w := newWriter(baseline)
+	w.SetBaselineRate(baseline)
+
+	w.SetRateLimit(baseline * 10) // boost
+	if err := w.RestoreBaseline(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	n, _ := w.Write(make([]byte, 20*1024))
+	realRate := float64(n) / time.Since(start).Seconds()
+	if realRate > baseline*1.05 || realRate < baseline*0.8 {
+		t.Errorf("rate %f after RestoreBaseline, want %f", realRate, baseline)
+	}
+}
+
+func TestBurstMultiplier(t *testing.T) {
+	w := newWriter(100 * 1024) // 100KB/sec
+	w.SetBurstMultiplier(0.1)
+	if b := w.Burst(); b != 10*1024 {
+		t.Errorf("Burst() = %d at 100KB/sec, want %d", b, 10*1024)
+	}
+	w.SetRateLimit(200 * 1024) // 200KB/sec
+	if b := w.Burst(); b != 20*1024 {
+		t.Errorf("Burst() = %d at 200KB/sec, want %d", b, 20*1024)
+	}
+	if b := w.Limiter().Burst(); b != 20*1024 {
+		t.Errorf("burst of the limiter %d, want %d", b, 20*1024)
+	}
+	w.SetBurst(4 * 1024)
+	if b := w.Burst(); b != 4*1024 {
+		t.Errorf("Burst() = %d with SetBurst, want %d", b, 4*1024)
+	}
+}
+
+func TestCostFunc(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	w := newWriter(limit)
+	w.SetCostFunc(func(p []byte) int {
+		return 2 * len(p)
+	})
+	start := time.Now()
+	var total int
+	for i := 0; i < 20; i++ {
+		n, err := w.Write(make([]byte, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1024 {
+			t.Fatalf("Write returned %d, want the real length", n)
+		}
+		total += n
+	}
+	realRate := float64(total) / time.Since(start).Seconds()
+	if realRate > limit/2*1.05 || realRate < limit/2*0.8 {
+		t.Errorf("rate %f with double cost, want %f", realRate, limit/2)
+	}
+}
+
+func TestString(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	w := shapeio.NewWriterWithContext(ioutil.Discard, ctx)
+	w.SetRateLimit(100 * 1024) // 100KB/sec
+	w.SetBurst(4096)
+	w.SetPacketModel(1500, 40)
+	w.Write(make([]byte, 1024))
+
+	s := w.String()
+	for _, want := range []string{"shapeio.Writer", "rate: 102400B/s", "burst: 4096B", "chunk: 1500B", "context: deadline", "total: 1024B"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%q does not contain %q", s, want)
+		}
+	}
+	if s := shapeio.NewReader(zeroReader{}).String(); !strings.Contains(s, "rate: unlimited") || !strings.Contains(s, "context: background") {
+		t.Errorf("unexpected summary %q", s)
+	}
+}
+
+func TestSetProgressFunc(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "trace-1")
+	sio := shapeio.NewReaderWithContext(bytes.NewReader(make([]byte, 8*1024)), ctx)
+	var traces []interface{}
+	var last int64
+	sio.SetProgressFunc(func(ctx context.Context, total int64) {
+		traces = append(traces, ctx.Value(key{}))
+		last = total
+	})
+	buf := make([]byte, 1024)
+	for {
+		if _, err := sio.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(traces) != 8 || last != 8*1024 {
+		t.Fatalf("progress called %d times with total %d", len(traces), last)
+	}
+	for _, v := range traces {
+		if v != "trace-1" {
+			t.Fatalf("context value %v in progress func", v)
+		}
+	}
+}
+
+func TestSwapRateLimit(t *testing.T) {
+	w := shapeio.NewWriter(ioutil.Discard)
+	const n = 100
+	prevs := make(chan float64, n)
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(limit float64) {
+			defer wg.Done()
+			prevs <- w.SwapRateLimit(limit)
+		}(float64(i * 1024))
+	}
+	wg.Wait()
+	close(prevs)
+
+	// every value but the last one set is returned once, as is the initial 0
+	seen := map[float64]int{w.RateLimit(): 1}
+	for prev := range prevs {
+		seen[prev]++
+	}
+	for i := 0; i <= n; i++ {
+		if c := seen[float64(i*1024)]; c != 1 {
+			t.Errorf("rate %d seen %d times", i*1024, c)
+		}
+	}
+
+	if prev := w.SwapRateLimit(0); prev == 0 {
+		t.Error("SwapRateLimit(0) returned 0 for a limited writer")
+	}
+	if limit := w.RateLimit(); limit != 0 {
+		t.Errorf("RateLimit() = %f after removing the limit", limit)
+	}
+}
+
+func TestFirstByteLatency(t *testing.T) {
+	delay := 100 * time.Millisecond
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 1024)))
+	sio.SetInitialDelay(delay)
+	if d := sio.FirstByteLatency(); d != 0 {
+		t.Fatalf("FirstByteLatency() = %s before reading", d)
+	}
+	buf := make([]byte, 512)
+	if _, err := sio.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	d := sio.FirstByteLatency()
+	if d < delay || d > delay+50*time.Millisecond {
+		t.Errorf("FirstByteLatency() = %s, want about %s", d, delay)
+	}
+	// set once
+	sio.Read(buf)
+	if again := sio.FirstByteLatency(); again != d {
+		t.Errorf("FirstByteLatency() changed to %s", again)
+	}
+
+	sio.Reset()
+	if d := sio.FirstByteLatency(); d != 0 {
+		t.Errorf("FirstByteLatency() = %s after Reset", d)
+	}
+}
+
+func TestStartAlignment(t *testing.T) {
+	interval := 100 * time.Millisecond
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 1024)))
+	sio.SetStartAlignment(interval)
+	if _, err := sio.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if off := now.Sub(now.Truncate(interval)); off > 20*time.Millisecond {
+		t.Errorf("first byte delivered %s after a boundary of %s", off, interval)
+	}
+
+	sio = shapeio.NewReader(bytes.NewReader(make([]byte, 1024)))
+	sio.SetStartAlignment(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sio.ReadContext(ctx, make([]byte, 512)); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("alignment wait ignored the context for %s", elapsed)
+	}
+}
+
+func TestWouldBlock(t *testing.T) {
+	limit := float64(10 * 1024) // 10KB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	if d := w.WouldBlock(1024 * 1024); d != 0 {
+		t.Errorf("WouldBlock() = %s without rate limit", d)
+	}
+	w.SetRateLimit(limit)
+	w.SetBurst(10 * 1024)
+	time.Sleep(time.Second) // fill the bucket
+	if d := w.WouldBlock(1024); d != 0 {
+		t.Errorf("WouldBlock() = %s with plenty of tokens", d)
+	}
+	tokens := w.Tokens()
+	if d := w.WouldBlock(20 * 1024); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+		t.Errorf("WouldBlock(20KB) = %s, want about 1s", d)
+	}
+	if after := w.Tokens(); after < tokens {
+		t.Errorf("WouldBlock consumed tokens: %f to %f", tokens, after)
+	}
+
+	w.TryWrite(make([]byte, 10*1024)) // deplete the bucket
+	if d := w.WouldBlock(5 * 1024); d < 400*time.Millisecond || d > 550*time.Millisecond {
+		t.Errorf("WouldBlock(5KB) = %s when depleted, want about 500ms", d)
+	}
+
+	// the committed rate without an excess pool
+	cir := shapeio.NewWriter(ioutil.Discard)
+	if err := cir.SetCIR(10*1024, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if d := cir.WouldBlock(5 * 1024); d < 400*time.Millisecond || d > 550*time.Millisecond {
+		t.Errorf("WouldBlock(5KB) = %s at the committed rate, want about 500ms", d)
+	}
+
+	if err := shapeio.SetGlobalRateLimit(limit); err != nil {
+		t.Fatal(err)
+	}
+	defer shapeio.SetGlobalRateLimit(0)
+	g := shapeio.NewWriter(ioutil.Discard)
+	if d := g.WouldBlock(5 * 1024); d < 400*time.Millisecond || d > 550*time.Millisecond {
+		t.Errorf("WouldBlock(5KB) = %s under the global cap, want about 500ms", d)
+	}
+}
+
+func TestSetLatencyFunc(t *testing.T) {
+	w := newWriter(10 * 1024) // 10KB/sec
+	var calls int
+	w.SetLatencyFunc(func() time.Duration {
+		calls++
+		return time.Duration(calls) * 20 * time.Millisecond // 20, 40, 60, 80ms
+	})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := w.Write(make([]byte, 512)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 200ms of the rate limit and 200ms of latency
+	if elapsed := time.Since(start); elapsed < 380*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("4 writes took %s, want about 400ms", elapsed)
+	}
+	if calls != 4 {
+		t.Errorf("latency func called %d times, want 4", calls)
+	}
+
+	w.SetLatencyFunc(func() time.Duration { return time.Hour })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, err := w.WriteContext(ctx, []byte("x")); n != 0 || err != context.DeadlineExceeded {
+		t.Errorf("WriteContext = %d, %v; want 0, %v", n, err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,50 @@
+package shapeio
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// slowStart paces the first bytes slowly.
+type slowStart struct {
+	n       int64
+	read    int64
+	limiter *rate.Limiter
+}
+
+func (s *shaper) setSlowStart(n int64, slowRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= 0 || slowRate <= 0 || slowRate >= MaxRate {
+		s.slowStart = nil
+		return
+	}
+	s.slowStart = &slowStart{n: n, limiter: newLimiter(slowRate)}
+}
+
+// slowStartRemaining returns the bytes left to be paced by slow start.
+func (s *shaper) slowStartRemaining() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slowStart == nil {
+		return 0
+	}
+	return s.slowStart.n - s.slowStart.read
+}
+
+// waitSlowStart waits for n bytes paced by slow start.
+func (s *shaper) waitSlowStart(ctx context.Context, n int) error {
+	s.mu.Lock()
+	ss := s.slowStart
+	if ss == nil || n <= 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	ss.read += int64(n)
+	if ss.read >= ss.n {
+		s.slowStart = nil
+	}
+	s.mu.Unlock()
+	return s.waitLimiter(ctx, ss.limiter, n)
+}
@@ -0,0 +1,44 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSlowStart(t *testing.T) {
+	slowRate := float64(20 * 1024) // 20KB/sec
+	n := int64(10 * 1024)
+	sio := shapeio.NewReader(bytes.NewReader(make([]byte, 100*1024)))
+	sio.SetSlowStart(n, slowRate)
+	buf := make([]byte, 4*1024)
+
+	start := time.Now()
+	var read int64
+	for read < n {
+		m, err := sio.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += int64(m)
+	}
+	if read != n {
+		t.Fatalf("slow start ended at %d bytes, want %d", read, n)
+	}
+	if realRate := float64(read) / time.Since(start).Seconds(); realRate > slowRate*1.05 {
+		t.Errorf("slow rate %f but real rate %f", slowRate, realRate)
+	}
+
+	start = time.Now()
+	rest, err := io.Copy(ioutil.Discard, sio)
+	if err != nil || rest != 90*1024 {
+		t.Fatalf("read %d bytes after slow start, %v", rest, err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("the remainder was throttled: %s", elapsed)
+	}
+}
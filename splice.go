@@ -0,0 +1,26 @@
+package shapeio
+
+import "io"
+
+// ReadFrom implements io.ReaderFrom. On Linux, if the underlying writer
+// implements io.ReaderFrom, such as *os.File and *net.TCPConn, it is used to
+// transfer in rate-sized chunks, allowing zero-copy transfers by splice(2)
+// and sendfile(2) while still pacing. Otherwise it copies through Write.
+func (s *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if err := s.waitStart(s.ctx); err != nil {
+		return 0, err
+	}
+	if err := s.flushFirst(s.ctx); err != nil {
+		return 0, err
+	}
+	return s.readFrom(r)
+}
+
+// writerOnly hides the ReadFrom method of Writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+func (s *Writer) copyFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{s}, r)
+}
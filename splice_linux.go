@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package shapeio
+
+import (
+	"io"
+	"time"
+)
+
+// spliceInterval is the span of bandwidth transferred by a chunk of ReadFrom.
+const spliceInterval = 100 * time.Millisecond
+
+// minSpliceChunk is the minimum size of a chunk of ReadFrom.
+const minSpliceChunk = 4 * 1024
+
+func (s *Writer) readFrom(r io.Reader) (int64, error) {
+	rf, ok := s.w.(io.ReaderFrom)
+	if !ok || s.leakyBucket() != nil || s.hasCostFunc() || s.postTransform() != nil {
+		// the cost function and the transform need the bytes
+		return s.copyFrom(r)
+	}
+	var total int64
+	for {
+		chunk := int64(s.rateLimit() * spliceInterval.Seconds())
+		if chunk < minSpliceChunk {
+			chunk = minSpliceChunk
+		}
+		if size := int64(s.chunkSize()); s.rateLimit() == 0 || chunk > size {
+			chunk = size
+		}
+		if m := int64(s.latencyAllowance(s.ctx)); m > 0 && chunk > m {
+			// each chunk blocks no longer than the latency bound
+			chunk = m
+		}
+		release, err := s.admitTransfer(s.ctx)
+		if err != nil {
+			return total, err
+		}
+		if err := s.waitLatency(s.ctx); err != nil {
+			release()
+			return total, err
+		}
+		n, err := s.splice(rf, r, chunk)
+		total += n
+		// bytes transferred along with an error are charged too
+		if werr := s.wait(s.ctx, int(n)+s.packetOverhead(int(n))); werr != nil && err == nil {
+			err = werr
+		}
+		release()
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+}
+
+// splice transfers up to chunk bytes from r by rf.
+func (s *Writer) splice(rf io.ReaderFrom, r io.Reader, chunk int64) (int64, error) {
+	s.iomu.Lock()
+	defer s.iomu.Unlock()
+	if s.isClosed() {
+		return 0, ErrClosed
+	}
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	m := int64(s.quotaAllowance(int(chunk)))
+	if m == 0 {
+		return 0, ErrQuotaExceeded
+	}
+	limiter, tokens := s.pauseTokens()
+	start := time.Now()
+	n, err := rf.ReadFrom(&io.LimitedReader{R: r, N: m})
+	s.resumeTokens(limiter, tokens)
+	s.recordIO(start, int(n))
+	s.record(int(n))
+	if aerr := s.account(int(n)); aerr != nil && err == nil {
+		err = aerr
+	}
+	if err == nil && n == m && m < chunk {
+		err = ErrQuotaExceeded
+	}
+	return n, err
+}
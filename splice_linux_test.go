@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestReadFromSplice(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	calls, realRate := readFrom(t, bytes.Repeat([]byte{1}, 50*1024), limit)
+	if calls < 2 {
+		t.Errorf("ReadFrom of the underlying writer called %d times, want chunks", calls)
+	}
+	if realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f on the splice path", limit, realRate)
+	}
+}
+
+// timedReadFrom records the time of its ReadFrom calls.
+type timedReadFrom struct {
+	bytes.Buffer
+	calls []time.Time
+}
+
+func (b *timedReadFrom) ReadFrom(r io.Reader) (int64, error) {
+	b.calls = append(b.calls, time.Now())
+	return b.Buffer.ReadFrom(r)
+}
+
+func TestReadFromSpliceMaxWriteLatency(t *testing.T) {
+	d := 100 * time.Millisecond
+	dst := &timedReadFrom{}
+	w := shapeio.NewWriter(dst)
+	w.SetRateLimit(10 * 1024) // 10KB/sec
+	w.SetMaxWriteLatency(d)
+
+	src := bytes.Repeat([]byte{1}, 16*1024)
+	if n, err := w.ReadFrom(bytes.NewReader(src)); err != nil || n != int64(len(src)) {
+		t.Fatalf("ReadFrom = %d, %v; want %d, nil", n, err, len(src))
+	}
+	for i := 1; i < len(dst.calls); i++ {
+		if gap := dst.calls[i].Sub(dst.calls[i-1]); gap > d+50*time.Millisecond {
+			t.Errorf("chunk %d blocked %s", i, gap)
+		}
+	}
+}
+
+func TestReadFromSpliceLatencyFunc(t *testing.T) {
+	dst := &readFromBuffer{}
+	w := shapeio.NewWriter(dst)
+	w.SetRateLimit(100 * 1024) // 100KB/sec
+	var calls int
+	w.SetLatencyFunc(func() time.Duration {
+		calls++
+		return 20 * time.Millisecond
+	})
+
+	src := bytes.Repeat([]byte{1}, 50*1024)
+	start := time.Now()
+	if n, err := w.ReadFrom(bytes.NewReader(src)); err != nil || n != int64(len(src)) {
+		t.Fatalf("ReadFrom = %d, %v; want %d, nil", n, err, len(src))
+	}
+	elapsed := time.Since(start)
+	if calls != dst.calls {
+		t.Errorf("latency func called %d times for %d chunks", calls, dst.calls)
+	}
+	// the rate limit and the latency of each chunk add up
+	if want := 500*time.Millisecond + time.Duration(calls)*20*time.Millisecond; elapsed < want-50*time.Millisecond {
+		t.Errorf("ReadFrom took %s, want about %s", elapsed, want)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package shapeio
+
+import "io"
+
+func (s *Writer) readFrom(r io.Reader) (int64, error) {
+	return s.copyFrom(r)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package shapeio_test
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadFromFallback(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	calls, realRate := readFrom(t, bytes.Repeat([]byte{1}, 50*1024), limit)
+	if calls != 0 {
+		t.Errorf("ReadFrom of the underlying writer called %d times, want the fallback", calls)
+	}
+	if realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f on the fallback path", limit, realRate)
+	}
+}
@@ -0,0 +1,39 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+// readFromBuffer counts its ReadFrom calls.
+type readFromBuffer struct {
+	bytes.Buffer
+	calls int
+}
+
+func (b *readFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.calls++
+	return b.Buffer.ReadFrom(r)
+}
+
+// readFrom copies src to a writer limited at bytesPerSec by ReadFrom, and
+// returns the ReadFrom calls to the underlying writer and the real rate.
+func readFrom(t *testing.T, src []byte, bytesPerSec float64) (int, float64) {
+	dst := &readFromBuffer{}
+	w := shapeio.NewWriter(dst)
+	w.SetRateLimit(bytesPerSec)
+	start := time.Now()
+	n, err := w.ReadFrom(bytes.NewReader(src))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(src)) || !bytes.Equal(dst.Bytes(), src) {
+		t.Fatalf("ReadFrom copied %d bytes, want %d", n, len(src))
+	}
+	return dst.calls, float64(n) / elapsed.Seconds()
+}
@@ -0,0 +1,50 @@
+package shapeio
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// State is a snapshot of the limiter state of a Reader or Writer, to resume
+// a transfer without granting a full burst.
+type State struct {
+	// Tokens is the bytes that could be transferred without waiting. It is
+	// negative while in debt.
+	Tokens float64
+	// Last is the time the snapshot was taken.
+	Last time.Time
+}
+
+func (s *shaper) snapshotState() State {
+	now := s.now()
+	limiter := s.getLimiter()
+	if limiter == nil {
+		return State{Tokens: math.Inf(1), Last: now}
+	}
+	return State{Tokens: limiter.TokensAt(now), Last: now}
+}
+
+// restoreState restores st into the limiter. Time elapsed since st.Last pays
+// off debt, but never earns more tokens than st.Tokens.
+func (s *shaper) restoreState(st State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limiter == nil || math.IsNaN(st.Tokens) {
+		return
+	}
+	now := s.now()
+	limit := s.limiter.Limit()
+	burst := s.limiter.Burst()
+	tokens := st.Tokens
+	if elapsed := now.Sub(st.Last); elapsed > 0 && tokens < 0 {
+		tokens = math.Min(tokens+elapsed.Seconds()*float64(limit), 0)
+	}
+	if tokens > float64(burst) {
+		tokens = float64(burst)
+	}
+	limiter := rate.NewLimiter(limit, burst)
+	burnTokens(limiter, now, float64(burst)-tokens)
+	s.limiter = limiter
+}
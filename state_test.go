@@ -0,0 +1,54 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSnapshotState(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateLimit(limit)
+	if err := w.SpendTokens(10 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	w.Reserve(20 * 1024)
+	st := w.SnapshotState()
+	if st.Tokens > -19*1024 {
+		t.Fatalf("unexpected tokens in snapshot: %f", st.Tokens)
+	}
+
+	resumed := shapeio.NewWriter(ioutil.Discard)
+	resumed.SetRateLimit(limit)
+	resumed.RestoreState(st)
+	start := time.Now()
+	if _, err := resumed.Write(bytes.Repeat([]byte{0}, 10*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("resumed writer burst: 10KB written in %s", elapsed)
+	}
+}
+
+func TestRestoreStateAfterIdle(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	w := shapeio.NewWriter(ioutil.Discard)
+	w.SetRateLimit(limit)
+
+	// Idle time pays off debt.
+	w.RestoreState(shapeio.State{Tokens: -20 * 1024, Last: time.Now().Add(-100 * time.Millisecond)})
+	if tokens := w.Tokens(); math.Abs(tokens+10*1024) > 1024 {
+		t.Errorf("unexpected tokens after paying off debt: %f", tokens)
+	}
+
+	// Idle time does not earn tokens.
+	w.RestoreState(shapeio.State{Tokens: 5 * 1024, Last: time.Now().Add(-time.Hour)})
+	if tokens := w.Tokens(); math.Abs(tokens-5*1024) > 1024 {
+		t.Errorf("unexpected tokens after idle: %f", tokens)
+	}
+}
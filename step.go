@@ -0,0 +1,65 @@
+package shapeio
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrInvalidFactor is returned by StepUp and StepDown for a factor not
+// positive and finite.
+var ErrInvalidFactor = errors.New("shapeio: invalid step factor")
+
+func (s *shaper) setRateBounds(min, max float64) error {
+	if math.IsNaN(min) || math.IsNaN(max) || min < 0 || max < 0 || max > 0 && max < min {
+		return ErrInvalidRate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minRate, s.maxRate = min, max
+	return nil
+}
+
+// stepRate multiplies the rate limit by factor, clamped to the bounds, and
+// returns the new one, or 0 if unlimited.
+func (s *shaper) stepRate(factor float64) (float64, error) {
+	if !validFactor(factor) {
+		return s.getRateLimit(), ErrInvalidFactor
+	}
+	s.mu.Lock()
+	bytesPerSec := s.targetRate()
+	if bytesPerSec == 0 {
+		// unlimited steps from the maximum, if any
+		if bytesPerSec = s.maxRate; bytesPerSec == 0 {
+			s.mu.Unlock()
+			return 0, nil
+		}
+	}
+	bytesPerSec *= factor
+	if s.maxRate > 0 && bytesPerSec > s.maxRate {
+		bytesPerSec = s.maxRate
+	}
+	if bytesPerSec < s.minRate {
+		bytesPerSec = s.minRate
+	}
+	err := s.applyRateLimit(bytesPerSec)
+	bytesPerSec = s.targetRate()
+	thrashed := s.thrash.count(time.Now())
+	s.mu.Unlock()
+	if thrashed != nil {
+		thrashed()
+	}
+	return bytesPerSec, err
+}
+
+// stepDown divides the rate limit by factor as stepRate multiplies it.
+func (s *shaper) stepDown(factor float64) (float64, error) {
+	if !validFactor(factor) {
+		return s.getRateLimit(), ErrInvalidFactor
+	}
+	return s.stepRate(1 / factor)
+}
+
+func validFactor(factor float64) bool {
+	return !math.IsNaN(factor) && factor > 0 && !math.IsInf(factor, 1)
+}
@@ -0,0 +1,53 @@
+package shapeio_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestStepRate(t *testing.T) {
+	w := shapeio.NewWriter(ioutil.Discard)
+	if err := w.SetRateBounds(1000, 64000); err != nil {
+		t.Fatal(err)
+	}
+	w.SetRateLimit(4000)
+	for i := 0; i < 10; i++ {
+		r, err := w.StepUp(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r > 64000 || w.RateLimit() != r {
+			t.Fatalf("StepUp = %.0f, RateLimit = %.0f; want at most 64000", r, w.RateLimit())
+		}
+	}
+	if r := w.RateLimit(); r != 64000 {
+		t.Errorf("RateLimit() = %.0f after stepping up, want 64000", r)
+	}
+	for i := 0; i < 10; i++ {
+		r, err := w.StepDown(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r < 1000 {
+			t.Fatalf("StepDown = %.0f, want at least 1000", r)
+		}
+	}
+	if r := w.RateLimit(); r != 1000 {
+		t.Errorf("RateLimit() = %.0f after stepping down, want 1000", r)
+	}
+
+	if _, err := w.StepUp(0); err != shapeio.ErrInvalidFactor {
+		t.Errorf("StepUp(0) = %v, want ErrInvalidFactor", err)
+	}
+	if err := w.SetRateBounds(2000, 1000); err != shapeio.ErrInvalidRate {
+		t.Errorf("SetRateBounds(2000, 1000) = %v, want ErrInvalidRate", err)
+	}
+
+	// unlimited steps from the maximum
+	w.SetRateLimit(0)
+	if r, _ := w.StepDown(2); r != 32000 {
+		t.Errorf("StepDown(2) from unlimited = %.0f, want 32000", r)
+	}
+}
@@ -0,0 +1,64 @@
+package shapeio
+
+import "time"
+
+// Summary is the lifetime statistics of a wrapper.
+type Summary struct {
+	// Total is the bytes transferred.
+	Total int64
+	// Elapsed is the time since the wrapper was created.
+	Elapsed time.Duration
+	// AvgRate is the average throughput (bytes/sec) over Elapsed.
+	AvgRate float64
+	// PeakRate is the highest throughput (bytes/sec) over a sampling window.
+	PeakRate float64
+	// RateLimit is the rate limit (bytes/sec), or 0 if unlimited.
+	RateLimit float64
+	// Blocked is the time spent waiting for the rate limit.
+	Blocked time.Duration
+}
+
+func (s *shaper) summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.meter.roll(now)
+	sum := Summary{
+		Total:     s.total,
+		Elapsed:   now.Sub(s.created),
+		PeakRate:  s.meter.peak,
+		RateLimit: s.targetRate(),
+		Blocked:   s.blocked,
+	}
+	if sum.Elapsed > 0 {
+		sum.AvgRate = float64(sum.Total) / sum.Elapsed.Seconds()
+	}
+	return sum
+}
+
+func (s *shaper) setSummaryFunc(f func(Summary)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summaryFunc = f
+}
+
+// summarize calls the function set by SetSummaryFunc, once.
+func (s *shaper) summarize() {
+	s.mu.Lock()
+	f := s.summaryFunc
+	if f == nil || s.summarized {
+		s.mu.Unlock()
+		return
+	}
+	s.summarized = true
+	s.mu.Unlock()
+	f(s.summary())
+}
+
+// addBlocked adds the time blocked in a wait started at start.
+func (s *shaper) addBlocked(start time.Time) {
+	d := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked += d
+}
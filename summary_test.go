@@ -0,0 +1,48 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSetSummaryFunc(t *testing.T) {
+	limit := float64(40 * 1024) // 40KB/sec
+	sio := shapeio.NewReader(ioutil.NopCloser(bytes.NewReader(make([]byte, 20*1024))))
+	sio.SetRateLimit(limit)
+	var summaries []shapeio.Summary
+	sio.SetSummaryFunc(func(s shapeio.Summary) {
+		summaries = append(summaries, s)
+	})
+	start := time.Now()
+	if _, err := io.Copy(ioutil.Discard, sio); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	sio.Close()
+	sio.Close()
+
+	if len(summaries) != 1 {
+		t.Fatalf("summary reported %d times", len(summaries))
+	}
+	s := summaries[0]
+	if s.Total != 20*1024 || s.RateLimit != limit {
+		t.Errorf("total %d at limit %f", s.Total, s.RateLimit)
+	}
+	if s.Elapsed < elapsed || s.Elapsed > elapsed+50*time.Millisecond {
+		t.Errorf("elapsed %s, want about %s", s.Elapsed, elapsed)
+	}
+	if s.AvgRate > limit*1.05 || s.AvgRate < limit*0.8 {
+		t.Errorf("average rate %f at limit %f", s.AvgRate, limit)
+	}
+	if s.PeakRate < s.AvgRate*0.8 {
+		t.Errorf("peak rate %f below average %f", s.PeakRate, s.AvgRate)
+	}
+	if s.Blocked < elapsed*3/4 || s.Blocked > s.Elapsed {
+		t.Errorf("blocked %s of %s", s.Blocked, s.Elapsed)
+	}
+}
@@ -0,0 +1,42 @@
+package shapeio
+
+import "time"
+
+// thrashDetector counts the rate limit changes over windows.
+type thrashDetector struct {
+	threshold int
+	window    time.Duration
+	f         func(changes int)
+
+	start   time.Time
+	changes int
+	fired   bool
+}
+
+// count counts a change at now, and returns the function to be called if the
+// changes exceed the threshold for the first time in the window. The lock of
+// the wrapper must be held.
+func (t *thrashDetector) count(now time.Time) func() {
+	if t.f == nil {
+		return nil
+	}
+	if t.start.IsZero() || now.Sub(t.start) >= t.window {
+		t.start, t.changes, t.fired = now, 0, false
+	}
+	t.changes++
+	if t.fired || t.changes <= t.threshold {
+		return nil
+	}
+	t.fired = true
+	f, changes := t.f, t.changes
+	return func() { f(changes) }
+}
+
+func (s *shaper) setThrashFunc(threshold int, window time.Duration, f func(changes int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if window <= 0 {
+		f = nil
+	}
+	s.thrash = thrashDetector{threshold: threshold, window: window, f: f}
+}
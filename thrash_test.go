@@ -0,0 +1,42 @@
+package shapeio_test
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestSetThrashFunc(t *testing.T) {
+	w := shapeio.NewWriter(ioutil.Discard)
+	var fired []int
+	w.SetThrashFunc(10, time.Second, func(changes int) {
+		fired = append(fired, changes)
+	})
+	for i := 0; i < 10; i++ {
+		w.SetRateLimit(float64(1024 * (i + 1)))
+	}
+	if len(fired) != 0 {
+		t.Fatalf("fired at %v changes within the threshold", fired)
+	}
+	for i := 0; i < 10; i++ {
+		w.SetRateLimit(float64(1024 * (i + 1)))
+	}
+	if len(fired) != 1 || fired[0] != 11 {
+		t.Errorf("fired at %v changes, want once at 11", fired)
+	}
+
+	// a slow controller does not trip it
+	fired = nil
+	w.SetThrashFunc(2, 50*time.Millisecond, func(changes int) {
+		fired = append(fired, changes)
+	})
+	for i := 0; i < 5; i++ {
+		w.SetRateLimit(1024)
+		time.Sleep(30 * time.Millisecond)
+	}
+	if len(fired) != 0 {
+		t.Errorf("fired at %v changes for a slow controller", fired)
+	}
+}
@@ -0,0 +1,207 @@
+package shapeio
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errRateChanged interrupts a wait for the rate limit changed meanwhile.
+var errRateChanged = errors.New("shapeio: rate limit changed")
+
+// WaitStrategy waits for the delays imposed by the rate limit.
+type WaitStrategy interface {
+	// Wait waits for d, or until ctx is done, in that case it returns
+	// ctx.Err().
+	Wait(ctx context.Context, d time.Duration) error
+}
+
+// timerWait is the default WaitStrategy. It reuses a single timer, and
+// allocates another one only while the timer is in use by a concurrent wait.
+type timerWait struct {
+	busy  int32
+	timer *time.Timer
+}
+
+func (w *timerWait) Wait(ctx context.Context, d time.Duration) error {
+	return w.wait(ctx, d, nil, nil)
+}
+
+// wait waits for d, or until ctx is done, changed is closed, or closing is
+// closed, in that case it returns ErrClosed.
+func (w *timerWait) wait(ctx context.Context, d time.Duration, changed, closing <-chan struct{}) error {
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		return waitTimer(ctx, t, changed, closing)
+	}
+	defer atomic.StoreInt32(&w.busy, 0)
+	if w.timer == nil {
+		w.timer = time.NewTimer(d)
+	} else {
+		w.timer.Reset(d)
+	}
+	err := waitTimer(ctx, w.timer, changed, closing)
+	if err != nil && !w.timer.Stop() {
+		// drain the channel for the next Reset
+		select {
+		case <-w.timer.C:
+		default:
+		}
+	}
+	return err
+}
+
+func waitTimer(ctx context.Context, t *time.Timer, changed, closing <-chan struct{}) error {
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+		return errRateChanged
+	case <-closing:
+		return ErrClosed
+	}
+}
+
+// sleepSlice is the longest sleep of sleepWait between checks of the
+// context.
+const sleepSlice = 10 * time.Millisecond
+
+// sleepWait is a WaitStrategy by a sleep function, which sleeps in slices to
+// check the context between them.
+type sleepWait func(d time.Duration)
+
+func (f sleepWait) Wait(ctx context.Context, d time.Duration) error {
+	for d > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		slice := d
+		if slice > sleepSlice {
+			slice = sleepSlice
+		}
+		f(slice)
+		d -= slice
+	}
+	return ctx.Err()
+}
+
+func (s *shaper) setSleepFunc(f func(d time.Duration)) {
+	if f == nil {
+		s.setWaitStrategy(nil)
+		return
+	}
+	s.setWaitStrategy(sleepWait(f))
+}
+
+func (s *shaper) setWaitStrategy(ws WaitStrategy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitStrategy = ws
+}
+
+func (s *shaper) getWaitStrategy() WaitStrategy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.waitStrategy != nil:
+		return s.waitStrategy
+	case s.clock != nil:
+		return s.clock
+	}
+	return &s.timerWait
+}
+
+// sleep waits for d by the wait strategy until ctx is done or the wrapper is
+// closed.
+func (s *shaper) sleep(ctx context.Context, d time.Duration) error {
+	return s.sleepOr(ctx, d, nil)
+}
+
+// sleepOr is like sleep, but returns errRateChanged once changed is closed.
+func (s *shaper) sleepOr(ctx context.Context, d time.Duration, changed <-chan struct{}) error {
+	var err error
+	if tw, ok := s.getWaitStrategy().(*timerWait); ok {
+		err = tw.wait(ctx, d, changed, s.closing)
+	} else {
+		wctx, cancel := s.withClose(ctx)
+		err = s.waitStrategyOr(wctx, d, changed)
+		cancel()
+	}
+	if err != nil && err != errRateChanged {
+		if derr := s.done(ctx); derr != nil {
+			return derr
+		}
+	}
+	return err
+}
+
+// waitStrategyOr waits for d by a custom wait strategy, which knows nothing
+// of changed, by cancelling its context once changed is closed.
+func (s *shaper) waitStrategyOr(ctx context.Context, d time.Duration, changed <-chan struct{}) error {
+	ws := s.getWaitStrategy()
+	if changed == nil {
+		return ws.Wait(ctx, d)
+	}
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+	err := ws.Wait(wctx, d)
+	if err != nil && ctx.Err() == nil {
+		select {
+		case <-changed:
+			return errRateChanged
+		default:
+		}
+	}
+	return err
+}
+
+// withClose returns a context that is done when ctx is, or the wrapper is
+// closed.
+func (s *shaper) withClose(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s *shaper) setKeepalive(interval time.Duration, fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepaliveInterval = interval
+	s.keepalive = fn
+}
+
+// throttle sleeps for d imposed by the rate limit, calling the keepalive
+// function at its interval meanwhile. It returns errRateChanged once changed
+// is closed.
+func (s *shaper) throttle(ctx context.Context, d time.Duration, changed <-chan struct{}) error {
+	s.mu.Lock()
+	interval, fn := s.keepaliveInterval, s.keepalive
+	s.mu.Unlock()
+	for fn != nil && interval > 0 && d > interval {
+		if err := s.sleepOr(ctx, interval, changed); err != nil {
+			return err
+		}
+		d -= interval
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return s.sleepOr(ctx, d, changed)
+}
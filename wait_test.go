@@ -0,0 +1,162 @@
+package shapeio_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestCloseCancelsWait(t *testing.T) {
+	sio := shapeio.NewReader(ioutil.NopCloser(zeroReader{}))
+	sio.SetRateLimit(10) // 10 bytes/sec
+	time.AfterFunc(100*time.Millisecond, func() { sio.Close() })
+
+	start := time.Now()
+	_, err := sio.Read(make([]byte, 1024))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Read returned %s after Close", elapsed)
+	}
+	if err != shapeio.ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := sio.Read(make([]byte, 1)); err != shapeio.ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+type countingWait struct {
+	waits int32
+}
+
+func TestSetWaitStrategy(t *testing.T) {
+	ws := &countingWait{}
+	w := newWriter(100 * 1024) // 100KB/sec
+	w.SetWaitStrategy(ws)
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&ws.waits); n != 5 {
+		t.Errorf("wait strategy called %d times, want 5", n)
+	}
+}
+
+// newTimerWait allocates a timer per wait, to compare with the default
+// strategy reusing one.
+type newTimerWait struct{}
+
+func (newTimerWait) Wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	buf := make([]byte, 32*1024)
+	for _, c := range []struct {
+		name  string
+		setup func(w *shapeio.Writer)
+	}{
+		{"timer", func(w *shapeio.Writer) {}},
+		{"sleep", func(w *shapeio.Writer) { w.SetSleepFunc(time.Sleep) }},
+		{"newtimer", func(w *shapeio.Writer) { w.SetWaitStrategy(newTimerWait{}) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			w := newWriter(50 * 1024 * 1024) // 50MB/sec
+			c.setup(w)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	sio := shapeio.NewReader(zeroReader{})
+	sio.SetRateLimit(1024) // 1KB/sec
+	var keepalives int32
+	sio.SetKeepalive(100*time.Millisecond, func() error {
+		atomic.AddInt32(&keepalives, 1)
+		return nil
+	})
+	// a read of 512 bytes waits for 500ms
+	if _, err := sio.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&keepalives); n < 3 || n > 5 {
+		t.Errorf("keepalive fired %d times during a wait of 500ms", n)
+	}
+
+	errKeepalive := errors.New("keepalive failed")
+	sio.SetKeepalive(100*time.Millisecond, func() error {
+		return errKeepalive
+	})
+	start := time.Now()
+	if _, err := sio.Read(make([]byte, 512)); err != errKeepalive {
+		t.Errorf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("keepalive error did not abort the read: %s", elapsed)
+	}
+}
+
+func TestSetSleepFunc(t *testing.T) {
+	var mu sync.Mutex
+	var slept time.Duration
+	w := newWriter(100 * 1024) // 100KB/sec
+	w.SetSleepFunc(func(d time.Duration) {
+		mu.Lock()
+		slept += d
+		mu.Unlock()
+		time.Sleep(d)
+	})
+	// 10KB waits for 100ms
+	if _, err := w.Write(make([]byte, 10*1024)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if slept < 90*time.Millisecond || slept > 110*time.Millisecond {
+		t.Errorf("slept %s by the sleep function, want about 100ms", slept)
+	}
+}
+
+func TestRaiseRateLimitOrder(t *testing.T) {
+	w := newWriter(1024) // 1KB/sec
+	w.SetBurst(1024)
+	done := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			w.Write(make([]byte, 1024))
+			done <- i
+		}(i)
+		time.Sleep(20 * time.Millisecond) // in order of arrival
+	}
+	start := time.Now()
+	w.SetRateLimit(20 * 1024) // 20KB/sec
+	for i := 0; i < 4; i++ {
+		if j := <-done; j != i {
+			t.Errorf("write %d completed as #%d", j, i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("blocked writes took %s to complete after raising the rate", elapsed)
+	}
+}
@@ -0,0 +1,99 @@
+package shapeio
+
+import (
+	"context"
+	"sync"
+)
+
+// writeBuffer coalesces small Writes of a Writer.
+type writeBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+// SetWriteBufferSize makes the writer accumulate Writes in a buffer of n
+// bytes, and write them out to the underlying writer, waiting for the rate
+// limit, when the buffer is full, on Flush and on Close. A Write of n bytes or
+// more is written out directly after the buffered bytes. Zero or less
+// disables buffering; the bytes buffered so far are written out with the next
+// Write or Flush.
+func (s *Writer) SetWriteBufferSize(n int) {
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	s.wbuf.size = n
+}
+
+// Buffered returns the number of bytes buffered and not yet written out.
+func (s *Writer) Buffered() int {
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	return len(s.wbuf.buf)
+}
+
+// Flush writes out the buffered bytes to the underlying writer, waiting for
+// the rate limit.
+func (s *Writer) Flush() error {
+	_, err := s.FlushContext(s.ctx)
+	return err
+}
+
+// FlushContext is like Flush, but waits for the rate limit until ctx is done.
+// It returns the number of bytes left in the buffer, which is non-zero along
+// with the error if the flush could not complete. The buffer is written out
+// in chunks of the burst, so a smaller burst (SetBurst) leaves more of it on
+// cancellation.
+func (s *Writer) FlushContext(ctx context.Context) (int, error) {
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	err := s.flushBuffer(ctx)
+	return len(s.wbuf.buf), err
+}
+
+// flushBuffer writes out the buffered bytes. s.wbuf.mu must be held.
+func (s *Writer) flushBuffer(ctx context.Context) error {
+	if len(s.wbuf.buf) == 0 {
+		return nil
+	}
+	n, err := s.writeChunks(ctx, s.wbuf.buf)
+	s.wbuf.buf = s.wbuf.buf[:copy(s.wbuf.buf, s.wbuf.buf[n:])]
+	return err
+}
+
+// flushFirst writes out the buffered bytes ahead of a write that bypasses the
+// buffer, so that the stream stays in order.
+func (s *Writer) flushFirst(ctx context.Context) error {
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	return s.flushBuffer(ctx)
+}
+
+// writeBuffered writes p through the write buffer. It reports false if
+// buffering is disabled and p must be written directly.
+func (s *Writer) writeBuffered(ctx context.Context, p []byte) (int, bool, error) {
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	size := s.wbuf.size
+	if size == 0 && len(s.wbuf.buf) == 0 {
+		return 0, false, nil
+	}
+	if size > 0 && s.wbuf.buf == nil {
+		s.wbuf.buf = make([]byte, 0, size)
+	}
+	if size > 0 && len(s.wbuf.buf)+len(p) <= size {
+		s.wbuf.buf = append(s.wbuf.buf, p...)
+		return len(p), true, nil
+	}
+	if err := s.flushBuffer(ctx); err != nil {
+		return 0, true, err
+	}
+	if len(p) >= size {
+		n, err := s.writeChunks(ctx, p)
+		return n, true, err
+	}
+	s.wbuf.buf = append(s.wbuf.buf, p...)
+	return len(p), true, nil
+}
@@ -0,0 +1,148 @@
+package shapeio_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryks/shapeio"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	limit := float64(100 * 1024) // 100KB/sec
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(limit)
+	w.SetWriteBufferSize(4 * 1024)
+
+	var src []byte
+	start := time.Now()
+	for i := 0; i < 2000; i++ {
+		p := bytes.Repeat([]byte{byte(i)}, 10)
+		src = append(src, p...)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := w.Buffered(); n == 0 || n > 4*1024 {
+		t.Errorf("Buffered() = %d", n)
+	}
+	// a large write passes through after the buffered bytes
+	large := bytes.Repeat([]byte{0xff}, 8*1024)
+	src = append(src, large...)
+	if _, err := w.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Buffered(); n != 0 {
+		t.Errorf("Buffered() = %d after a large write", n)
+	}
+	w.Write([]byte("tail"))
+	src = append(src, "tail"...)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Fatalf("wrote %d bytes, want %d", dst.Len(), len(src))
+	}
+	if realRate := float64(len(src)) / elapsed.Seconds(); realRate > limit*1.05 {
+		t.Errorf("Limit %f but real rate %f", limit, realRate)
+	}
+	if waits := w.Waits(); waits > 10 {
+		t.Errorf("%d waits for 2000 small writes", waits)
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	p := make([]byte, 16)
+	for _, size := range []int{0, 32 * 1024} {
+		name := "unbuffered"
+		if size > 0 {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			w := shapeio.NewWriter(ioutil.Discard)
+			w.SetRateLimit(50 * 1024 * 1024) // 50MB/sec
+			w.SetWriteBufferSize(size)
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(w.Waits())/float64(b.N), "waits/op")
+		})
+	}
+}
+
+func TestFlushContext(t *testing.T) {
+	var dst bytes.Buffer
+	w := shapeio.NewWriter(&dst)
+	w.SetRateLimit(1024) // 1KB/sec
+	w.SetBurst(1024)
+	w.SetWriteBufferSize(4 * 1024)
+	if _, err := w.Write(make([]byte, 3*1024)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	remaining, err := w.FlushContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("FlushContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("FlushContext() took %s", elapsed)
+	}
+	if remaining == 0 || remaining != w.Buffered() || remaining+dst.Len() != 3*1024 {
+		t.Errorf("%d bytes remaining, %d buffered, %d written", remaining, w.Buffered(), dst.Len())
+	}
+}
+
+func TestWriteBufferOrder(t *testing.T) {
+	paths := map[string]func(w *shapeio.Writer, p []byte) error{
+		"ReadFrom": func(w *shapeio.Writer, p []byte) error {
+			_, err := w.ReadFrom(bytes.NewReader(p))
+			return err
+		},
+		"WriteBuffers": func(w *shapeio.Writer, p []byte) error {
+			_, err := w.WriteBuffers(net.Buffers{p[:1], p[1:]})
+			return err
+		},
+	}
+	for name, write := range paths {
+		var dst bytes.Buffer
+		w := shapeio.NewWriter(&dst)
+		w.SetWriteBufferSize(16)
+		w.Write([]byte("AAA"))
+		if err := write(w, []byte("BBB")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		w.Write([]byte("CCC"))
+		w.Close()
+		if got := dst.String(); got != "AAABBBCCC" {
+			t.Errorf("%s: wrote %q, want %q", name, got, "AAABBBCCC")
+		}
+	}
+
+	var dst strings.Builder
+	m := shapeio.NewMessageWriter(&dst, 0)
+	m.SetWriteBufferSize(16)
+	m.Write([]byte("AAA"))
+	if err := m.WriteMessage([]byte("BBB")); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if got := dst.String(); got != "AAABBB" {
+		t.Errorf("WriteMessage: wrote %q, want %q", got, "AAABBB")
+	}
+}